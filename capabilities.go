@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The bits of an MTTS terminal type, as sent by MUD clients in their
+// third TTYPE reply.
+const (
+	MttsAnsi		= 1
+	MttsVT100		= 2
+	MttsUTF8		= 4
+	Mtts256Colors		= 8
+	MttsMouseTracking	= 16
+	MttsOscPalette		= 32
+	MttsScreenReader	= 64
+	MttsProxy		= 128
+	MttsTrueColor		= 256
+	MttsMnes		= 512
+	MttsMslp		= 1024
+	MttsSsl			= 2048
+)
+
+// What a client's terminal is known to support.  Clients describe
+// themselves in different ways: telnet MUD clients with a client name and
+// an MTTS bitfield, others only with a terminal type such as
+// "xterm-256color".  Both are kept, and the methods below combine them.
+type Capabilities struct {
+	ClientName	string
+	TerminalType	string
+	MTTS		int
+	GMCP		bool
+}
+
+func (c Capabilities) String() string {
+	return fmt.Sprintf("client %q, terminal %q, MTTS %d, colors %s, UTF-8 %t, screen reader %t",
+		c.ClientName, c.TerminalType, c.MTTS, c.ColorDepth(), c.UTF8(), c.ScreenReader())
+}
+
+// Terminal types known to show the 16 ANSI colors.
+var colorTerminals = []string{"ANSI", "XTERM", "LINUX", "SCREEN", "TMUX", "RXVT",
+	"PUTTY", "CYGWIN", "KONSOLE", "VT220", "VT320", "VT420", "VT525", "MUDLET",
+	"MUSHCLIENT", "TINTIN", "ZMUD", "CMUD"}
+
+// ColorDepth returns the most colors the terminal is known to show.
+func (c Capabilities) ColorDepth() ColorDepth {
+	depth := ColorNone
+
+	switch {
+	case c.MTTS & MttsTrueColor != 0:
+		depth = ColorTrue
+	case c.MTTS & Mtts256Colors != 0:
+		depth = Color256
+	case c.MTTS & MttsAnsi != 0:
+		depth = Color16
+	}
+
+	t := strings.ToUpper(c.TerminalType)
+	switch {
+	case strings.Contains(t, "TRUECOLOR"), strings.Contains(t, "24BIT"), strings.Contains(t, "DIRECT"):
+		return ColorTrue
+	case strings.Contains(t, "256"):
+		return ColorDepth(Maxi(int(depth), int(Color256)))
+	case strings.Contains(t, "COLOR"):
+		return ColorDepth(Maxi(int(depth), int(Color16)))
+	}
+
+	for _, name := range colorTerminals {
+		if strings.HasPrefix(t, name) {
+			return ColorDepth(Maxi(int(depth), int(Color16)))
+		}
+	}
+
+	return depth
+}
+
+// UTF8 reports whether the terminal decodes UTF-8.
+func (c Capabilities) UTF8() bool {
+	t := strings.ToUpper(c.TerminalType)
+	return c.MTTS & MttsUTF8 != 0 || strings.Contains(t, "UTF-8") || strings.Contains(t, "UTF8")
+}
+
+// ScreenReader reports whether the player uses a screen reader.
+func (c Capabilities) ScreenReader() bool {
+	return c.MTTS & MttsScreenReader != 0
+}
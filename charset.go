@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// How characters are encoded for a terminal.
+type Charset int
+
+const (
+	CharsetASCII Charset = iota
+	CharsetCP437
+	CharsetUTF8
+)
+
+var charsetNames = map[Charset]string{
+	CharsetASCII:	"ASCII",
+	CharsetCP437:	"CP437",
+	CharsetUTF8:	"UTF-8",
+}
+
+func (c Charset) String() string {
+	return charsetNames[c]
+}
+
+// Charset returns the character set the terminal shows.  Terminals that
+// call themselves ANSI without claiming UTF-8 are BBS style terminals
+// with the IBM PC font.  Anything else unknown gets plain ASCII.
+func (c Capabilities) Charset() Charset {
+	switch {
+	case c.UTF8():
+		return CharsetUTF8
+	case strings.HasPrefix(strings.ToUpper(c.TerminalType), "ANSI"):
+		return CharsetCP437
+	}
+
+	return CharsetASCII
+}
+
+// The characters of code page 437 from 0x80 up.
+var cp437High = [128]rune{
+	'Ç', 'ü', 'é', 'â', 'ä', 'à', 'å', 'ç', 'ê', 'ë', 'è', 'ï', 'î', 'ì', 'Ä', 'Å',
+	'É', 'æ', 'Æ', 'ô', 'ö', 'ò', 'û', 'ù', 'ÿ', 'Ö', 'Ü', '¢', '£', '¥', '₧', 'ƒ',
+	'á', 'í', 'ó', 'ú', 'ñ', 'Ñ', 'ª', 'º', '¿', '⌐', '¬', '½', '¼', '¡', '«', '»',
+	'░', '▒', '▓', '│', '┤', '╡', '╢', '╖', '╕', '╣', '║', '╗', '╝', '╜', '╛', '┐',
+	'└', '┴', '┬', '├', '─', '┼', '╞', '╟', '╚', '╔', '╩', '╦', '╠', '═', '╬', '╧',
+	'╨', '╤', '╥', '╙', '╘', '╒', '╓', '╫', '╪', '┘', '┌', '█', '▄', '▌', '▐', '▀',
+	'α', 'ß', 'Γ', 'π', 'Σ', 'σ', 'µ', 'τ', 'Φ', 'Θ', 'Ω', 'δ', '∞', 'φ', 'ε', '∩',
+	'≡', '±', '≥', '≤', '⌠', '⌡', '÷', '≈', '°', '∙', '·', '√', 'ⁿ', '²', '■', '\u00a0',
+}
+
+var cp437Bytes = make(map[rune]byte)
+
+// Plain characters to show instead of symbols on ASCII terminals.
+var asciiFallbacks = map[rune]byte{
+	'≈': '~', '·': '.', '∙': '.', '×': 'x', '○': 'o', '•': '*', '♣': '&',
+	'░': '#', '▒': '#', '▓': '#', '█': '#', '■': '#', '▄': '_', '▀': '-',
+	'─': '-', '═': '=', '│': '|', '║': '|', '╱': '/', '╲': '\\',
+	'┌': '+', '┐': '+', '└': '+', '┘': '+', '├': '+', '┤': '+', '┬': '+', '┴': '+', '┼': '+',
+	'╔': '+', '╗': '+', '╚': '+', '╝': '+', '╠': '+', '╣': '+', '╦': '+', '╩': '+', '╬': '+',
+	'\u00a0': ' ',
+}
+
+// Characters that terminals show two columns wide: East Asian wide and
+// fullwidth characters, and emoji.
+var wideRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x1100, 0x115f, 1}, {0x231a, 0x231b, 1}, {0x2329, 0x232a, 1},
+		{0x23e9, 0x23ec, 1}, {0x23f0, 0x23f3, 3}, {0x25fd, 0x25fe, 1},
+		{0x2614, 0x2615, 1}, {0x2648, 0x2653, 1}, {0x267f, 0x2693, 20},
+		{0x26a1, 0x26aa, 9}, {0x26ab, 0x26bd, 18}, {0x26be, 0x26c4, 6},
+		{0x26c5, 0x26ce, 9}, {0x26d4, 0x26ea, 22}, {0x26f2, 0x26f3, 1},
+		{0x26f5, 0x26fa, 5}, {0x26fd, 0x2705, 8}, {0x270a, 0x270b, 1},
+		{0x2728, 0x274c, 36}, {0x274e, 0x2753, 5}, {0x2754, 0x2755, 1},
+		{0x2757, 0x2795, 62}, {0x2796, 0x2797, 1}, {0x27b0, 0x27bf, 15},
+		{0x2b1b, 0x2b1c, 1}, {0x2b50, 0x2b55, 5}, {0x2e80, 0x303e, 1},
+		{0x3041, 0x33ff, 1}, {0x3400, 0x4dbf, 1}, {0x4e00, 0x9fff, 1},
+		{0xa000, 0xa4cf, 1}, {0xa960, 0xa97f, 1}, {0xac00, 0xd7a3, 1},
+		{0xf900, 0xfaff, 1}, {0xfe10, 0xfe19, 1}, {0xfe30, 0xfe6f, 1},
+		{0xff00, 0xff60, 1}, {0xffe0, 0xffe6, 1},
+	},
+	R32: []unicode.Range32{
+		{0x16fe0, 0x16fe4, 1}, {0x17000, 0x18cff, 1}, {0x1b000, 0x1b2ff, 1},
+		{0x1f004, 0x1f0cf, 203}, {0x1f18e, 0x1f191, 3}, {0x1f192, 0x1f19a, 1},
+		{0x1f200, 0x1f251, 1}, {0x1f300, 0x1f64f, 1}, {0x1f680, 0x1f6ff, 1},
+		{0x1f7e0, 0x1f7eb, 1}, {0x1f90c, 0x1f9ff, 1}, {0x1fa70, 0x1faff, 1},
+		{0x20000, 0x2fffd, 1}, {0x30000, 0x3fffd, 1},
+	},
+}
+
+// isNarrow reports whether a character takes up exactly one column.
+// Screen cells hold one character each, so wide characters and ones
+// that combine with the character before them would shift the rest of
+// the line.
+func isNarrow(r rune) bool {
+	return !unicode.In(r, wideRunes, unicode.Mn, unicode.Me, unicode.Cf)
+}
+
+func init() {
+	// 0xff is the telnet IAC byte, so the non-breaking space it stands
+	// for is sent as a plain space instead.
+	for i, r := range cp437High[:len(cp437High) - 1] {
+		cp437Bytes[r] = byte(0x80 + i)
+	}
+}
+
+// appendRune appends a character in a character set.  Characters the set
+// lacks, or that are not one column wide, are replaced with a plain
+// look-alike or a question mark.  Control characters are never sent.
+func appendRune(b []byte, r rune, charset Charset) []byte {
+	if r >= ' ' && r < 0x7f {
+		return append(b, byte(r))
+	}
+
+	switch charset {
+	case CharsetUTF8:
+		if r >= 0xa0 && isNarrow(r) {
+			var buf [utf8.UTFMax]byte
+			return append(b, buf[:utf8.EncodeRune(buf[:], r)]...)
+		}
+	case CharsetCP437:
+		if c, ok := cp437Bytes[r]; ok {
+			return append(b, c)
+		}
+	}
+
+	if c, ok := asciiFallbacks[r]; ok {
+		return append(b, c)
+	}
+
+	return append(b, '?')
+}
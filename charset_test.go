@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAppendRune(t *testing.T) {
+	tests := []struct {
+		r	rune
+		charset	Charset
+		want	string
+	}{
+		{'a', CharsetUTF8, "a"},
+		{'é', CharsetUTF8, "é"},
+		{'≈', CharsetUTF8, "≈"},
+		{'≈', CharsetCP437, "\xf7"},
+		{'≈', CharsetASCII, "~"},
+		{'\x1b', CharsetUTF8, "?"},
+		{'\u0085', CharsetUTF8, "?"},
+		{'中', CharsetUTF8, "?"},
+		{'한', CharsetUTF8, "?"},
+		{'Ａ', CharsetUTF8, "?"},
+		{'😀', CharsetUTF8, "?"},
+		{'\u0301', CharsetUTF8, "?"},
+		{'\u200b', CharsetUTF8, "?"},
+		{'\u00a0', CharsetCP437, " "},
+	}
+
+	for _, test := range tests {
+		if got := string(appendRune(nil, test.r, test.charset)); got != test.want {
+			t.Errorf("appendRune(%q, %s) = %q, want %q", test.r, test.charset, got, test.want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 type ChatService interface {
 	Send(origin Entity, message string)
+	SendNearby(origin Entity, radius int, format func(listener Entity) string)
+	Announce(message string)
 	Register(e Entity, handler func(Entity, string))
 	Unregister(e Entity)
 }
@@ -21,10 +23,34 @@ func (s *chatService) Send(origin Entity, message string) {
 	}
 }
 
+// SendNearby sends a message to every listener within radius tiles of the
+// origin.  The message is built per listener so that it can be phrased
+// differently for the origin, a target or a bystander.  Listeners for
+// which format returns an empty string are skipped.
+func (s *chatService) SendNearby(origin Entity, radius int, format func(listener Entity) string) {
+	ox, oy := origin.GetPosition()
+
+	for e, handler := range s.handlers {
+		x, y := e.GetPosition()
+		if Maxi(Absi(x - ox), Absi(y - oy)) > radius {
+			continue
+		}
+
+		if message := format(e); message != "" {
+			handler(origin, message)
+		}
+	}
+}
+
+// Announce sends a system message, one without an origin, to everyone.
+func (s *chatService) Announce(message string) {
+	s.Send(nil, message)
+}
+
 func (s *chatService) Register(e Entity, handler func(Entity, string)) {
 	s.handlers[e] = handler
 }
 
 func (s *chatService) Unregister(e Entity) {
 	delete(s.handlers, e)
-}
\ No newline at end of file
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+)
+
+// A color as 0xRRGGBB, or ColorDefault for the terminal's own color.
+type Color int32
+
+const ColorDefault Color = -1
+
+func RGB(r, g, b uint8) Color {
+	return Color(r) << 16 | Color(g) << 8 | Color(b)
+}
+
+func (c Color) rgb() (int, int, int) {
+	return int(c >> 16 & 0xff), int(c >> 8 & 0xff), int(c & 0xff)
+}
+
+// How many colors a terminal can show.
+type ColorDepth int
+
+const (
+	ColorNone ColorDepth = iota
+	Color16
+	Color256
+	ColorTrue
+)
+
+var colorDepthNames = map[ColorDepth]string{
+	ColorNone:	"none",
+	Color16:	"16",
+	Color256:	"256",
+	ColorTrue:	"truecolor",
+}
+
+func (d ColorDepth) String() string {
+	return colorDepthNames[d]
+}
+
+// The colors a cell is drawn with.
+type Style struct {
+	Fg, Bg	Color
+}
+
+var DefaultStyle = Style{ColorDefault, ColorDefault}
+
+// The colors of the 16 color palette, as xterm shows them.
+var ansiPalette = [16]Color{
+	0x000000, 0xcd0000, 0x00cd00, 0xcdcd00, 0x0000ee, 0xcd00cd, 0x00cdcd, 0xe5e5e5,
+	0x7f7f7f, 0xff0000, 0x00ff00, 0xffff00, 0x5c5cff, 0xff00ff, 0x00ffff, 0xffffff,
+}
+
+// The levels of each component in the 256 color cube.
+var cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+func distance(c Color, r, g, b int) int {
+	cr, cg, cb := c.rgb()
+	return (cr - r) * (cr - r) + (cg - g) * (cg - g) + (cb - b) * (cb - b)
+}
+
+// nearest16 returns the index of the closest color in the 16 color
+// palette.
+func nearest16(c Color) int {
+	r, g, b := c.rgb()
+
+	best := 0
+	for i, p := range ansiPalette {
+		if distance(p, r, g, b) < distance(ansiPalette[best], r, g, b) {
+			best = i
+		}
+	}
+
+	return best
+}
+
+// nearest256 returns the index of the closest color in the 6x6x6 cube or
+// the gray ramp of the 256 color palette.
+func nearest256(c Color) int {
+	r, g, b := c.rgb()
+
+	level := func(v int) int {
+		best := 0
+		for i, l := range cubeLevels {
+			if Absi(l - v) < Absi(cubeLevels[best] - v) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	ri, gi, bi := level(r), level(g), level(b)
+	cube := RGB(uint8(cubeLevels[ri]), uint8(cubeLevels[gi]), uint8(cubeLevels[bi]))
+
+	gray := Mini(23, Maxi(0, ((r + g + b) / 3 - 8 + 5) / 10))
+	grayLevel := uint8(8 + 10 * gray)
+
+	if distance(RGB(grayLevel, grayLevel, grayLevel), r, g, b) < distance(cube, r, g, b) {
+		return 232 + gray
+	}
+
+	return 16 + 36 * ri + 6 * gi + bi
+}
+
+// appendColor appends the SGR parameters that select a color.  base is
+// 30 for the foreground and 40 for the background.
+func appendColor(b []byte, c Color, base int, depth ColorDepth) []byte {
+	if c == ColorDefault {
+		return strconv.AppendInt(b, int64(base + 9), 10)
+	}
+
+	switch depth {
+	case Color16:
+		i := nearest16(c)
+		if i >= 8 {
+			return strconv.AppendInt(b, int64(base + 60 + i - 8), 10)
+		}
+		return strconv.AppendInt(b, int64(base + i), 10)
+	case Color256:
+		b = strconv.AppendInt(b, int64(base + 8), 10)
+		b = append(b, ";5;"...)
+		return strconv.AppendInt(b, int64(nearest256(c)), 10)
+	}
+
+	r, g, bl := c.rgb()
+	b = strconv.AppendInt(b, int64(base + 8), 10)
+	b = append(b, ";2;"...)
+	b = strconv.AppendInt(b, int64(r), 10)
+	b = append(b, ';')
+	b = strconv.AppendInt(b, int64(g), 10)
+	b = append(b, ';')
+	return strconv.AppendInt(b, int64(bl), 10)
+}
+
+// appendStyle appends the sequence that switches to a style, at the
+// given color depth.
+func appendStyle(b []byte, s Style, depth ColorDepth) []byte {
+	b = append(b, TelnetEsc, '[')
+	b = appendColor(b, s.Fg, 30, depth)
+	b = append(b, ';')
+	b = appendColor(b, s.Bg, 40, depth)
+	return append(b, 'm')
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A command typed into the chat box with a leading slash, e.g. "/me waves".
+// args holds everything after the command name with surrounding spaces
+// removed.
+type chatCommand func(p *playerEntity, args string)
+
+var chatCommands map[string]chatCommand
+
+func init() {
+	chatCommands = map[string]chatCommand{
+		"me":		doMe,
+		"emotes":	doEmotes,
+		"who":		doWho,
+		"bind":		doBind,
+		"unbind":	doUnbind,
+		"sshkey":	doSSHKey,
+		"look":		doLook,
+		"where":	doWhere,
+		"screenreader":	doScreenReader,
+	}
+
+	for name := range emotes {
+		chatCommands[name] = makeEmoteCommand(name)
+	}
+}
+
+// runChatCommand parses a line of the form "/name args" and runs the
+// matching command on behalf of the player.
+func runChatCommand(p *playerEntity, line string) {
+	name, args := splitCommand(strings.TrimPrefix(line, "/"))
+	command, ok := chatCommands[strings.ToLower(name)]
+	if !ok {
+		p.notify("Unknown command: /" + name)
+		return
+	}
+
+	command(p, args)
+}
+
+// splitCommand splits a command line into the command name and its
+// arguments, trimming the spaces around them.
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i + 1:])
+	}
+
+	return line, ""
+}
+
+func doEmotes(p *playerEntity, args string) {
+	names := make([]string, 0, len(emotes))
+	for name := range emotes {
+		names = append(names, "/" + name)
+	}
+	sort.Strings(names)
+
+	p.notify("Emotes: " + strings.Join(names, " "))
+}
+
+// whoList returns a table of the players currently online, sorted by
+// name.  It must be called from the game loop or within Synchronize.
+func whoList(g Game) []string {
+	players := make([]PlayerEntity, 0, 16)
+	for e := range g.GetEntities() {
+		if p, ok := e.(PlayerEntity); ok {
+			players = append(players, p)
+		}
+	}
+	sort.Sort(playersByName(players))
+
+	lines := make([]string, 0, len(players) + 2)
+	lines = append(lines, fmt.Sprintf("%-16s %8s  %s", "Name", "Idle", "Zone"))
+	for _, p := range players {
+		x, y := p.GetPosition()
+		idle := formatIdleTime(p.GetIdleTime())
+		if p.IsLinkDead() {
+			idle = "linkdead"
+		}
+		lines = append(lines, fmt.Sprintf("%-16s %8s  %s", p.GetName(), idle, zoneAt(x, y)))
+	}
+	lines = append(lines, fmt.Sprintf("%d player(s) online", len(players)))
+
+	return lines
+}
+
+type playersByName []PlayerEntity
+
+func (s playersByName) Len() int		{ return len(s) }
+func (s playersByName) Swap(i, j int)		{ s[i], s[j] = s[j], s[i] }
+func (s playersByName) Less(i, j int) bool	{ return s[i].GetName() < s[j].GetName() }
+
+// formatIdleTime formats a duration in its largest whole unit, e.g. "42s"
+// or "3m".
+func formatIdleTime(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d / time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d / time.Minute))
+	}
+
+	return fmt.Sprintf("%dh", int(d / time.Hour))
+}
+
+func doWho(p *playerEntity, args string) {
+	for _, line := range whoList(p.owner) {
+		p.notify(line)
+	}
+}
+
+// doBind lists the player's key bindings, or with arguments of the form
+// "<key> <action>" changes one and saves it to their account.
+func doBind(p *playerEntity, args string) {
+	if args == "" {
+		for _, line := range p.bindings.Describe() {
+			p.notify(line)
+		}
+		return
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		p.notify("Usage: /bind <key> <action>")
+		return
+	}
+
+	setBinding(p, fields[0], fields[1])
+}
+
+func doUnbind(p *playerEntity, args string) {
+	if args == "" || strings.ContainsRune(args, ' ') {
+		p.notify("Usage: /unbind <key>")
+		return
+	}
+
+	setBinding(p, args, ActionNone.String())
+}
+
+func setBinding(p *playerEntity, keyName, actionName string) {
+	key, ok := ParseKeyEvent(keyName)
+	if !ok {
+		p.notify("Unknown key: " + keyName)
+		return
+	}
+
+	action, ok := ParseAction(actionName)
+	if !ok {
+		p.notify("Unknown action: " + actionName)
+		return
+	}
+
+	if err := p.bindings.CheckBinding(key, action); err != nil {
+		p.notify(capitalize(err.Error()) + ".")
+		return
+	}
+
+	p.bindings[key] = action
+	p.notify(fmt.Sprintf("%s is now bound to %s.", key, action))
+
+	name := p.GetName()
+	theDatabaseWriter.Save(func() error {
+		return theDatabase.SetKeyBinding(name, key.String(), action.String())
+	}, func(err error) {
+		p.owner.Post(func() {
+			p.notify(fmt.Sprintf("Your binding of %s could not be saved.", key))
+		})
+	})
+}
+
+// doSSHKey adds a public key, given as a line from authorized_keys, that
+// the player can use to log in over SSH.
+func doSSHKey(p *playerEntity, args string) {
+	key, err := ParsePublicKey(args)
+	if err != nil {
+		p.notify("Usage: /sshkey <type> <base64 key>")
+		return
+	}
+
+	name := p.GetName()
+	go func() {
+		message := "Public key added."
+		if !theDatabase.AddPublicKey(name, key) {
+			message = "You have already added that key."
+		}
+
+		p.owner.Post(func() {
+			p.notify(message)
+		})
+	}()
+}
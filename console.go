@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The server console reads commands for the administrator from standard
+// input, one per line, e.g. "kick bob" or "spawn dog 20 40".
+
+// A console command writes its output to out.  It returns errUsage when
+// its arguments make no sense.
+type consoleCommand struct {
+	usage	string
+	help	string
+	run	func(out io.Writer, args string) error
+}
+
+var (
+	errUsage	= errors.New("usage")
+	errQuit		= errors.New("quit")
+)
+
+var consoleCommands map[string]consoleCommand
+
+func init() {
+	consoleCommands = map[string]consoleCommand{
+		"help":		{"help", "list the commands", consoleHelp},
+		"who":		{"who", "list the players online", consoleWho},
+		"kick":		{"kick <name> [reason]", "disconnect a player", consoleKick},
+		"ban":		{"ban <address>", "refuse connections from an address or CIDR range", consoleBan},
+		"unban":	{"unban <address>", "lift a ban", consoleUnban},
+		"bans":		{"bans", "list the banned addresses", consoleBans},
+		"broadcast":	{"broadcast <message>", "send a message to every player", consoleBroadcast},
+		"teleport":	{"teleport <name> <x> <y> | <name> <player>", "move a player", consoleTeleport},
+		"spawn":	{"spawn <monster> [<x> <y>]", "add a monster to the world", consoleSpawn},
+		"reload":	{"reload map", "load the world map again from " + worldMapFile, consoleReload},
+		"stats":	{"stats", "show how the server is doing", consoleStats},
+		"save":		{"save", "save where every player is", consoleSave},
+		"quit":		{"quit", "save and stop the server", consoleQuit},
+	}
+}
+
+// Monsters the console can spawn.
+var monsters = map[string]func(x, y int, g Game) Entity{
+	"dog":	MakeDog,
+}
+
+// runConsole runs commands read from in until it ends or the quit command
+// is given.
+func runConsole(in io.Reader, out io.Writer) {
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Print(err)
+			}
+			return
+		}
+
+		if !runConsoleCommand(out, line) {
+			return
+		}
+	}
+}
+
+// runConsoleCommand runs a line typed at the console, returning false if
+// it was quit.
+func runConsoleCommand(out io.Writer, line string) bool {
+	name, args := splitCommand(line)
+	if name == "" {
+		return true
+	}
+
+	command, ok := consoleCommands[strings.ToLower(name)]
+	if !ok {
+		fmt.Fprintf(out, "Unknown command: %s.  Type help for a list of commands.\n", name)
+		return true
+	}
+
+	switch err := command.run(out, args); err {
+	case nil:
+	case errQuit:
+		return false
+	case errUsage:
+		fmt.Fprintf(out, "Usage: %s\n", command.usage)
+	default:
+		fmt.Fprintln(out, err.Error())
+	}
+
+	return true
+}
+
+func consoleHelp(out io.Writer, args string) error {
+	names := make([]string, 0, len(consoleCommands))
+	for name := range consoleCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := consoleCommands[name]
+		fmt.Fprintf(out, "%-44s %s\n", c.usage, c.help)
+	}
+
+	return nil
+}
+
+func consoleWho(out io.Writer, args string) error {
+	theGame.Synchronize(func() {
+		for _, line := range whoList(theGame) {
+			fmt.Fprintln(out, line)
+		}
+	})
+
+	return nil
+}
+
+// findPlayer returns the player of a user in the world, or an error
+// saying there is none.  It may only be used on the game goroutine.
+func findPlayer(name string) (PlayerEntity, error) {
+	if p := theGame.FindPlayer(name); p != nil {
+		return p, nil
+	}
+
+	return nil, errors.New(name + " is not in the world")
+}
+
+func consoleKick(out io.Writer, args string) error {
+	name, reason := splitCommand(args)
+	if name == "" {
+		return errUsage
+	} else if reason == "" {
+		reason = "You have been disconnected by the administrator."
+	}
+
+	var err error
+	theGame.Synchronize(func() {
+		var p PlayerEntity
+		if p, err = findPlayer(name); err == nil {
+			p.Kick(reason)
+		}
+	})
+
+	if err == nil {
+		fmt.Fprintf(out, "Kicked %s\n", name)
+	}
+	return err
+}
+
+func consoleBan(out io.Writer, args string) error {
+	if args == "" {
+		return errUsage
+	} else if err := theGatekeeper.Ban(args); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Banned %s\n", args)
+	return nil
+}
+
+func consoleUnban(out io.Writer, args string) error {
+	if args == "" {
+		return errUsage
+	} else if !theGatekeeper.Unban(args) {
+		return errors.New(args + " is not banned")
+	}
+
+	fmt.Fprintf(out, "Unbanned %s\n", args)
+	return nil
+}
+
+func consoleBans(out io.Writer, args string) error {
+	bans := theGatekeeper.GetBans()
+	for _, ban := range bans {
+		fmt.Fprintln(out, ban)
+	}
+	fmt.Fprintf(out, "%d ban(s)\n", len(bans))
+
+	return nil
+}
+
+func consoleBroadcast(out io.Writer, args string) error {
+	if args == "" {
+		return errUsage
+	}
+
+	theGame.Post(func() {
+		theGame.GetChat().Announce("Server: " + args)
+	})
+
+	return nil
+}
+
+// parsePosition parses the "<x> <y>" that ends some console commands.
+func parsePosition(fields []string) (int, int, error) {
+	if len(fields) != 2 {
+		return 0, 0, errUsage
+	}
+
+	x, errX := strconv.Atoi(fields[0])
+	y, errY := strconv.Atoi(fields[1])
+	if errX != nil || errY != nil {
+		return 0, 0, errUsage
+	}
+
+	return x, y, nil
+}
+
+// consoleTeleport moves a player to a position or to another player.
+func consoleTeleport(out io.Writer, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) != 2 && len(fields) != 3 {
+		return errUsage
+	}
+
+	x, y, err := 0, 0, error(nil)
+	if len(fields) == 3 {
+		if x, y, err = parsePosition(fields[1:]); err != nil {
+			return err
+		}
+	}
+
+	theGame.Synchronize(func() {
+		var p, target PlayerEntity
+		if p, err = findPlayer(fields[0]); err != nil {
+			return
+		}
+
+		if len(fields) == 2 {
+			if target, err = findPlayer(fields[1]); err != nil {
+				return
+			}
+			x, y = target.GetPosition()
+		} else if !isOpen(theGame.GetMap(), x, y) {
+			err = fmt.Errorf("%d, %d is not open ground", x, y)
+			return
+		}
+
+		p.SetPosition(x, y)
+		p.Notify(fmt.Sprintf("You have been moved to %s.", zoneAt(x, y)))
+	})
+
+	if err == nil {
+		fmt.Fprintf(out, "Moved %s to %d, %d\n", fields[0], x, y)
+	}
+	return err
+}
+
+// consoleSpawn adds a monster at a position, or at a spawn point if none
+// is given.
+func consoleSpawn(out io.Writer, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) != 1 && len(fields) != 3 {
+		return errUsage
+	}
+
+	makeMonster, ok := monsters[strings.ToLower(fields[0])]
+	if !ok {
+		names := make([]string, 0, len(monsters))
+		for name := range monsters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return errors.New("unknown monster, try " + joinWords(names))
+	}
+
+	x, y, err := 0, 0, error(nil)
+	if len(fields) == 3 {
+		if x, y, err = parsePosition(fields[1:]); err != nil {
+			return err
+		}
+	}
+
+	theGame.Synchronize(func() {
+		m := theGame.GetMap()
+		if len(fields) == 1 {
+			if x, y, ok = findSpawnPoint(m); !ok {
+				err = errors.New("the spawn points are not open ground")
+			}
+		} else if !isOpen(m, x, y) {
+			err = fmt.Errorf("%d, %d is not open ground", x, y)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	theGame.AddEntity(makeMonster(x, y, theGame))
+	fmt.Fprintf(out, "Spawned a %s at %d, %d\n", strings.ToLower(fields[0]), x, y)
+	return nil
+}
+
+// consoleReload loads the world map again, so that it can be edited
+// without restarting the server.
+func consoleReload(out io.Writer, args string) error {
+	if strings.ToLower(args) != "map" {
+		return errUsage
+	}
+
+	m, err := LoadMapFromFile(worldMapFile)
+	if err != nil {
+		return err
+	} else if _, _, ok := findSpawnPoint(m); !ok {
+		return errors.New(worldMapFile + ": the spawn points are not open ground")
+	}
+
+	theGame.Synchronize(func() {
+		theGame.SetMap(m)
+	})
+
+	w, h := m.GetSize()
+	fmt.Fprintf(out, "Loaded %s, %dx%d\n", worldMapFile, w, h)
+	return nil
+}
+
+func consoleStats(out io.Writer, args string) error {
+	players, linkDead, others := 0, 0, 0
+	var sent OutputStats
+	theGame.Synchronize(func() {
+		for e := range theGame.GetEntities() {
+			p, ok := e.(PlayerEntity)
+			switch {
+			case !ok:
+				others++
+			case p.IsLinkDead():
+				linkDead++
+			default:
+				players++
+				stats := p.GetTerminal().GetStats()
+				sent.Frames += stats.Frames
+				sent.Bytes += stats.Bytes
+			}
+		}
+	})
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	uptime := time.Since(serverStartTime) / time.Second * time.Second
+	fmt.Fprintf(out, "Uptime      %s\n", uptime)
+	fmt.Fprintf(out, "Players     %d online, %d link-dead\n", players, linkDead)
+	fmt.Fprintf(out, "Monsters    %d\n", others)
+	fmt.Fprintf(out, "Sent        %d frames, %d bytes to players online\n", sent.Frames, sent.Bytes)
+	fmt.Fprintf(out, "Goroutines  %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(out, "Memory      %d KiB in use\n", mem.HeapAlloc / 1024)
+	fmt.Fprintf(out, "Bans        %d\n", len(theGatekeeper.GetBans()))
+
+	return nil
+}
+
+// savePositions saves where every player in the world is.  Players are
+// also saved when they leave.
+func savePositions() int {
+	positions := make(map[string][2]int)
+	theGame.Synchronize(func() {
+		for e := range theGame.GetEntities() {
+			if p, ok := e.(PlayerEntity); ok {
+				x, y := p.GetPosition()
+				positions[p.GetName()] = [2]int{x, y}
+			}
+		}
+	})
+
+	for name, position := range positions {
+		theDatabase.SetPosition(name, position[0], position[1])
+	}
+
+	return len(positions)
+}
+
+func consoleSave(out io.Writer, args string) error {
+	fmt.Fprintf(out, "Saved %d player(s)\n", savePositions())
+	return nil
+}
+
+func consoleQuit(out io.Writer, args string) error {
+	return errQuit
+}
@@ -7,18 +7,43 @@ import (
 	"log"
 )
 
+// A stack of identical items a user carries.
+type InventoryItem struct {
+	Id	int
+	Name	string
+	Count	int
+}
+
 type Database interface {
 	Close()
 	Authenticate(name string, password string) bool
 	CreateUser(name string, password string, email string) (bool, error)
 	UserExists(name string) bool
+	GetKeyBindings(name string) map[string]string
+	SetKeyBinding(name string, key string, action string) error
+	AuthenticateKey(name string, key string) bool
+	AddPublicKey(name string, key string) bool
+	GetInventory(name string) []InventoryItem
+	GetScreenReader(name string) bool
+	SetScreenReader(name string, enabled bool) error
+	GetPosition(name string) (int, int, bool)
+	SetPosition(name string, x, y int)
 }
 
 type database struct {
-	db		mysql.Conn
-	authStmt	mysql.Stmt
-	createUserStmt	mysql.Stmt
-	userExistsStmt	mysql.Stmt
+	db			mysql.Conn
+	authStmt		mysql.Stmt
+	createUserStmt		mysql.Stmt
+	userExistsStmt		mysql.Stmt
+	keyBindingsStmt		mysql.Stmt
+	setKeyBindingStmt	mysql.Stmt
+	authKeyStmt		mysql.Stmt
+	addKeyStmt		mysql.Stmt
+	inventoryStmt		mysql.Stmt
+	screenReaderStmt	mysql.Stmt
+	setScreenReaderStmt	mysql.Stmt
+	positionStmt		mysql.Stmt
+	setPositionStmt		mysql.Stmt
 }
 
 func checkError(err error) {
@@ -37,12 +62,39 @@ func (d *database) prepareStatements() {
 	checkError(err)
 	d.userExistsStmt, err = db.Prepare("CALL user_exists(?)")
 	checkError(err)
+	d.keyBindingsStmt, err = db.Prepare("CALL user_keybindings(?)")
+	checkError(err)
+	d.setKeyBindingStmt, err = db.Prepare("CALL set_user_keybinding(?, ?, ?)")
+	checkError(err)
+	d.authKeyStmt, err = db.Prepare("CALL authenticate_key(?, ?)")
+	checkError(err)
+	d.addKeyStmt, err = db.Prepare("CALL add_user_key(?, ?)")
+	checkError(err)
+	d.inventoryStmt, err = db.Prepare("CALL user_inventory(?)")
+	checkError(err)
+	d.screenReaderStmt, err = db.Prepare("CALL user_screen_reader(?)")
+	checkError(err)
+	d.setScreenReaderStmt, err = db.Prepare("CALL set_user_screen_reader(?, ?)")
+	checkError(err)
+	d.positionStmt, err = db.Prepare("CALL user_position(?)")
+	checkError(err)
+	d.setPositionStmt, err = db.Prepare("CALL set_user_position(?, ?, ?)")
+	checkError(err)
 }
 
 func (d *database) terminateStatements() {
 	d.authStmt.Delete()
 	d.createUserStmt.Delete()
 	d.userExistsStmt.Delete()
+	d.keyBindingsStmt.Delete()
+	d.setKeyBindingStmt.Delete()
+	d.authKeyStmt.Delete()
+	d.addKeyStmt.Delete()
+	d.inventoryStmt.Delete()
+	d.screenReaderStmt.Delete()
+	d.setScreenReaderStmt.Delete()
+	d.positionStmt.Delete()
+	d.setPositionStmt.Delete()
 }
 
 func MakeDatabase() Database {
@@ -63,15 +115,23 @@ func (d *database) Close() {
 }
 
 func eatRemainingResults(res mysql.Result) {
+	checkError(skipResults(res))
+}
+
+// skipResults reads the results of a call that are left after its rows.
+func skipResults(res mysql.Result) error {
 	var err error = nil
 	for !res.StatusOnly() {
 		res, err = res.NextResult()
-		checkError(err)
+		if err != nil {
+			return err
+		}
 		if res == nil {
-			log.Fatal("nil query result!")
+			return errors.New("nil query result!")
 		}
 	}
 
+	return nil
 }
 
 func (d *database) Authenticate(name string, password string) bool {
@@ -111,3 +171,162 @@ func (d *database) UserExists(name string) bool {
 	eatRemainingResults(res)
 	return exists
 }
+
+// GetKeyBindings returns the key bindings a user has changed from the
+// defaults, keyed by key name.
+func (d *database) GetKeyBindings(name string) map[string]string {
+	rows, res, err := d.keyBindingsStmt.Exec(name)
+	checkError(err)
+
+	bindings := make(map[string]string, len(rows))
+	for _, row := range rows {
+		bindings[row.Str(0)] = row.Str(1)
+	}
+
+	eatRemainingResults(res)
+	return bindings
+}
+
+func (d *database) SetKeyBinding(name string, key string, action string) error {
+	res, err := d.setKeyBindingStmt.Run(name, key, action)
+	if err != nil {
+		return err
+	}
+
+	return skipResults(res)
+}
+
+// AuthenticateKey checks whether a public key, in authorized_keys form,
+// belongs to a user.
+func (d *database) AuthenticateKey(name string, key string) bool {
+	row, res, err := d.authKeyStmt.ExecFirst(name, key)
+	checkError(err)
+
+	success, err := row.BoolErr(0)
+	checkError(err)
+
+	eatRemainingResults(res)
+	return success
+}
+
+// AddPublicKey adds a public key to a user, returning false if the user
+// already had it.
+func (d *database) AddPublicKey(name string, key string) bool {
+	row, res, err := d.addKeyStmt.ExecFirst(name, key)
+	checkError(err)
+
+	added, err := row.BoolErr(0)
+	checkError(err)
+
+	eatRemainingResults(res)
+	return added
+}
+
+// GetInventory returns the items a user carries, grouped by item.
+func (d *database) GetInventory(name string) []InventoryItem {
+	rows, res, err := d.inventoryStmt.Exec(name)
+	checkError(err)
+
+	items := make([]InventoryItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, InventoryItem{Id: row.Int(1),
+			Name: row.Str(2),
+			Count: row.Int(0)})
+	}
+
+	eatRemainingResults(res)
+	return items
+}
+
+// GetScreenReader returns whether a user plays in screen reader mode.
+func (d *database) GetScreenReader(name string) bool {
+	row, res, err := d.screenReaderStmt.ExecFirst(name)
+	checkError(err)
+
+	enabled, err := row.BoolErr(0)
+	checkError(err)
+
+	eatRemainingResults(res)
+	return enabled
+}
+
+func (d *database) SetScreenReader(name string, enabled bool) error {
+	res, err := d.setScreenReaderStmt.Run(name, enabled)
+	if err != nil {
+		return err
+	}
+
+	return skipResults(res)
+}
+
+// GetPosition returns where a user's player was when it was last saved,
+// if it ever was.
+func (d *database) GetPosition(name string) (int, int, bool) {
+	rows, res, err := d.positionStmt.Exec(name)
+	checkError(err)
+
+	x, y, ok := 0, 0, len(rows) > 0
+	if ok {
+		x, y = rows[0].Int(0), rows[0].Int(1)
+	}
+
+	eatRemainingResults(res)
+	return x, y, ok
+}
+
+func (d *database) SetPosition(name string, x, y int) {
+	res, err := d.setPositionStmt.Run(name, x, y)
+	checkError(err)
+
+	eatRemainingResults(res)
+}
+
+// A DatabaseWriter saves changes for the game goroutine, which must not
+// wait on the database.  Changes are made one at a time in the order
+// they were saved, so the last change a user makes is the one kept.
+type DatabaseWriter interface {
+	// Save queues a change.  If it fails, failed is called with the
+	// error from the writer's goroutine.
+	Save(change func() error, failed func(err error))
+
+	// Close waits for the queued changes to be made.
+	Close()
+}
+
+type databaseChange struct {
+	change	func() error
+	failed	func(err error)
+}
+
+type databaseWriter struct {
+	changes	chan databaseChange
+	done	chan bool
+}
+
+func MakeDatabaseWriter() DatabaseWriter {
+	w := &databaseWriter{changes: make(chan databaseChange, 256),
+		done: make(chan bool)}
+	go w.run()
+
+	return w
+}
+
+func (w *databaseWriter) run() {
+	for c := range w.changes {
+		if err := c.change(); err != nil {
+			log.Print(err)
+			c.failed(err)
+		}
+	}
+
+	close(w.done)
+}
+
+func (w *databaseWriter) Save(change func() error, failed func(err error)) {
+	w.changes <- databaseChange{change, failed}
+}
+
+func (w *databaseWriter) Close() {
+	close(w.changes)
+	<-w.done
+}
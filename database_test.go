@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestDatabaseWriter saves changes that must be made in order, one of
+// which fails.
+func TestDatabaseWriter(t *testing.T) {
+	w := MakeDatabaseWriter()
+	errSave := errors.New("save failed")
+
+	var made []int
+	var failed []error
+	for i := 0; i < 1000; i++ {
+		i := i
+		w.Save(func() error {
+			made = append(made, i)
+			if i == 500 {
+				return errSave
+			}
+			return nil
+		}, func(err error) {
+			failed = append(failed, err)
+		})
+	}
+	w.Close()
+
+	if len(made) != 1000 {
+		t.Fatalf("%d of 1000 changes made", len(made))
+	}
+	for i, n := range made {
+		if n != i {
+			t.Fatalf("change %d made in place of change %d", n, i)
+		}
+	}
+
+	if len(failed) != 1 || failed[0] != errSave {
+		t.Errorf("failures reported: %v, want only %s", failed, errSave)
+	}
+}
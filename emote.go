@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Players within this many tiles of an emote will see it.
+const emoteRange = 12
+
+// A predefined emote.  Each message is shown to a different audience:
+// the actor, a bystander, and, when a target is given, the target.
+// Bystander and target messages take the actor's name as the first
+// argument; targeted messages take the target's name as the last.
+type emote struct {
+	self		string
+	others		string
+	selfTarget	string
+	target		string
+	othersTarget	string
+}
+
+var emotes = map[string]emote{
+	"bow": {"You bow.", "%s bows.",
+		"You bow to %s.", "%s bows to you.", "%s bows to %s."},
+	"wave": {"You wave.", "%s waves.",
+		"You wave at %s.", "%s waves at you.", "%s waves at %s."},
+	"nod": {"You nod.", "%s nods.",
+		"You nod at %s.", "%s nods at you.", "%s nods at %s."},
+	"laugh": {"You laugh.", "%s laughs.",
+		"You laugh at %s.", "%s laughs at you.", "%s laughs at %s."},
+	"smile": {"You smile.", "%s smiles.",
+		"You smile at %s.", "%s smiles at you.", "%s smiles at %s."},
+	"cheer": {"You cheer.", "%s cheers.",
+		"You cheer for %s.", "%s cheers for you.", "%s cheers for %s."},
+	"shrug": {"You shrug.", "%s shrugs.",
+		"You shrug at %s.", "%s shrugs at you.", "%s shrugs at %s."},
+	"poke": {"You poke the air.", "%s pokes the air.",
+		"You poke %s.", "%s pokes you.", "%s pokes %s."},
+}
+
+// findNearbyPlayer returns the player with the given name within range
+// of the entity, or nil if there is none.
+func findNearbyPlayer(g Game, origin Entity, name string, radius int) PlayerEntity {
+	ox, oy := origin.GetPosition()
+
+	for e := range g.GetEntities() {
+		p, ok := e.(PlayerEntity)
+		if !ok || !strings.EqualFold(p.GetName(), name) {
+			continue
+		}
+
+		x, y := p.GetPosition()
+		if Maxi(Absi(x - ox), Absi(y - oy)) <= radius {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func makeEmoteCommand(name string) chatCommand {
+	em := emotes[name]
+
+	return func(p *playerEntity, args string) {
+		chat := p.owner.GetChat()
+
+		if args == "" {
+			chat.SendNearby(p, emoteRange, func(listener Entity) string {
+				if listener == p {
+					return em.self
+				}
+				return fmt.Sprintf(em.others, p.GetName())
+			})
+			return
+		}
+
+		target := findNearbyPlayer(p.owner, p, args, emoteRange)
+		if target == nil {
+			p.notify(fmt.Sprintf("There is nobody called %s nearby.", args))
+			return
+		}
+
+		if target == PlayerEntity(p) {
+			p.notify("You can't do that to yourself.")
+			return
+		}
+
+		chat.SendNearby(p, emoteRange, func(listener Entity) string {
+			switch listener {
+			case p:
+				return fmt.Sprintf(em.selfTarget, target.GetName())
+			case target:
+				return fmt.Sprintf(em.target, p.GetName())
+			}
+			return fmt.Sprintf(em.othersTarget, p.GetName(), target.GetName())
+		})
+	}
+}
+
+// doMe handles free-form actions such as "/me waves happily".  Bystanders
+// see "Bob waves happily." while the actor sees "You wave happily."
+func doMe(p *playerEntity, args string) {
+	if args == "" {
+		p.notify("Usage: /me <action>")
+		return
+	}
+
+	action := strings.TrimRight(args, ".!?")
+	punctuation := args[len(action):]
+	if punctuation == "" {
+		punctuation = "."
+	}
+
+	self := "You " + secondPerson(action) + punctuation
+	others := p.GetName() + " " + action + punctuation
+
+	p.owner.GetChat().SendNearby(p, emoteRange, func(listener Entity) string {
+		if listener == p {
+			return self
+		}
+		return others
+	})
+}
+
+// irregularVerbs maps third person verbs to their second person forms
+// where simply dropping the suffix does not work.
+var irregularVerbs = map[string]string{
+	"is":	"are",
+	"has":	"have",
+	"does":	"do",
+	"goes":	"go",
+	"was":	"were",
+}
+
+// secondPerson rewrites the leading verb of an action from third to
+// second person, e.g. "waves" to "wave" or "watches" to "watch".
+func secondPerson(action string) string {
+	verb, rest := action, ""
+	if i := strings.IndexByte(action, ' '); i >= 0 {
+		verb, rest = action[:i], action[i:]
+	}
+
+	lower := strings.ToLower(verb)
+	if v, ok := irregularVerbs[lower]; ok {
+		return v + rest
+	}
+
+	switch {
+	case strings.HasSuffix(lower, "ies") && len(verb) > 3:
+		verb = verb[:len(verb) - 3] + "y"
+	case strings.HasSuffix(lower, "sses"), strings.HasSuffix(lower, "shes"),
+		strings.HasSuffix(lower, "ches"), strings.HasSuffix(lower, "xes"),
+		strings.HasSuffix(lower, "zzes"), strings.HasSuffix(lower, "oes"):
+		verb = verb[:len(verb) - 2]
+	case strings.HasSuffix(lower, "s") && !strings.HasSuffix(lower, "ss"):
+		verb = verb[:len(verb) - 1]
+	}
+
+	return verb + rest
+}
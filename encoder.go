@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+)
+
+// A FrameEncoder turns the deltas of a frame into a single buffer of ANSI
+// escape sequences and text that can be sent with one write.  It tracks
+// where the terminal cursor is between frames so that it can use short
+// relative movements instead of absolute positioning when they are
+// cheaper.  Colors are sent only when they change, at the depth the
+// terminal supports, and characters in the terminal's character set.
+type FrameEncoder struct {
+	width	int
+	cx, cy	int
+	clear	bool
+	depth	ColorDepth
+	charset	Charset
+	style	Style
+	buffer	[]byte
+}
+
+// MakeFrameEncoder creates an encoder for a screen of the given width.
+// The cursor position is unknown until the first absolute move.
+func MakeFrameEncoder(width int) *FrameEncoder {
+	return &FrameEncoder{width: width,
+		cx: -1,
+		cy: -1,
+		style: DefaultStyle,
+		buffer: make([]byte, 0, 1024)}
+}
+
+// Invalidate forgets the cursor position, for instance after something
+// else has written to the terminal.
+func (e *FrameEncoder) Invalidate() {
+	e.cx, e.cy = -1, -1
+}
+
+// SetWidth changes the width of the terminal, which decides where the
+// right margin is.
+func (e *FrameEncoder) SetWidth(width int) {
+	e.width = width
+}
+
+// SetColorDepth changes how many colors are used.  With ColorNone no
+// colors are sent at all.
+func (e *FrameEncoder) SetColorDepth(depth ColorDepth) {
+	e.depth = depth
+}
+
+// SetCharset changes how characters are encoded.
+func (e *FrameEncoder) SetCharset(charset Charset) {
+	e.charset = charset
+}
+
+// Reset makes the next frame start by clearing the terminal.  It is used
+// together with Screen.Invalidate to redraw everything from scratch.
+func (e *FrameEncoder) Reset() {
+	e.Invalidate()
+	e.clear = true
+}
+
+// Encode returns the bytes that draw a frame.  The returned slice is only
+// valid until the next call.
+func (e *FrameEncoder) Encode(frame []ScreenDelta) []byte {
+	e.buffer = e.buffer[:0]
+
+	if e.clear {
+		if e.depth != ColorNone {
+			e.buffer = append(e.buffer, TelnetEsc, '[', 'm')
+			e.style = DefaultStyle
+		}
+		e.buffer = append(e.buffer, TelnetEsc, '[', 'H', TelnetEsc, '[', '2', 'J')
+		e.cx, e.cy = 0, 0
+		e.clear = false
+	}
+
+	for _, d := range frame {
+		e.moveTo(d.x, d.y)
+		if e.depth != ColorNone && d.style != e.style {
+			e.buffer = appendStyle(e.buffer, d.style, e.depth)
+			e.style = d.style
+		}
+		for _, r := range d.data {
+			e.buffer = appendRune(e.buffer, r, e.charset)
+		}
+		e.cx += len(d.data)
+
+		// At the right margin terminals differ in where the cursor
+		// ends up, so stop relying on it.
+		if e.cx >= e.width {
+			e.Invalidate()
+		}
+	}
+
+	return e.buffer
+}
+
+// moveTo appends the cheapest sequence that moves the cursor to x, y.
+func (e *FrameEncoder) moveTo(x, y int) {
+	if x == e.cx && y == e.cy {
+		return
+	}
+
+	absolute := appendCursorPosition(nil, x, y)
+
+	if e.cx >= 0 {
+		relative := make([]byte, 0, 16)
+
+		switch {
+		case y < e.cy:
+			relative = appendCsi(relative, e.cy - y, 'A')
+		case y > e.cy:
+			relative = appendCsi(relative, y - e.cy, 'B')
+		}
+
+		switch {
+		case x == 0 && e.cx != 0:
+			relative = append(relative, '\r')
+		case x > e.cx:
+			relative = appendCsi(relative, x - e.cx, 'C')
+		case x < e.cx:
+			relative = appendCsi(relative, e.cx - x, 'D')
+		}
+
+		if len(relative) < len(absolute) {
+			absolute = relative
+		}
+	}
+
+	e.buffer = append(e.buffer, absolute...)
+	e.cx, e.cy = x, y
+}
+
+// appendCursorPosition appends an absolute move to a zero based position.
+func appendCursorPosition(b []byte, x, y int) []byte {
+	b = append(b, TelnetEsc, '[')
+	b = strconv.AppendInt(b, int64(y + 1), 10)
+	b = append(b, ';')
+	b = strconv.AppendInt(b, int64(x + 1), 10)
+	return append(b, 'H')
+}
+
+// appendCsi appends a control sequence with a single count, leaving the
+// count out when it is the default of one.
+func appendCsi(b []byte, n int, final byte) []byte {
+	b = append(b, TelnetEsc, '[')
+	if n != 1 {
+		b = strconv.AppendInt(b, int64(n), 10)
+	}
+	return append(b, final)
+}
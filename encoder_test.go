@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// A countingTransport throws away what is written to it, counting the
+// bytes and the writes.
+type countingTransport struct {
+	bytes, writes	int64
+}
+
+func (*countingTransport) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *countingTransport) Write(b []byte) (int, error) {
+	c.bytes += int64(len(b))
+	c.writes++
+	return len(b), nil
+}
+
+func (*countingTransport) Close() error {
+	return nil
+}
+
+func (*countingTransport) GetScreenSize() (int, int) {
+	return 80, 24
+}
+
+func (*countingTransport) GetCapabilities() Capabilities {
+	return Capabilities{TerminalType: "XTERM", MTTS: MttsAnsi | MttsUTF8 | Mtts256Colors}
+}
+
+// drawTestView fills a screen with terrain in a few colors, much like
+// the map view.
+func drawTestView(s Screen) {
+	terrain := []struct {
+		char	rune
+		style	Style
+	}{
+		{'.', DefaultStyle},
+		{'.', DefaultStyle},
+		{'≈', Style{RGB(0, 0, 205), ColorDefault}},
+		{'♣', Style{RGB(0, 205, 0), ColorDefault}},
+		{'#', Style{RGB(127, 127, 127), ColorDefault}},
+	}
+
+	w, h := s.GetSize()
+	for y := 0; y < h; y++ {
+		s.GoTo(0, y)
+		for x := 0; x < w; x++ {
+			t := terrain[(x / 3 + y / 2 * 7) % len(terrain)]
+			s.SetStyle(t.style)
+			s.Put(t.char)
+		}
+	}
+}
+
+// benchmarkDraw reports what a terminal sends for each frame drawn.
+func benchmarkDraw(b *testing.B, draw func(s Screen) bool) {
+	transport := &countingTransport{}
+	term := MakeTerminal(transport)
+	defer term.Close()
+
+	s := MakeScreen(transport.GetScreenSize())
+	drawTestView(s)
+	term.Draw(s.GetDelta(), true)
+	s.Flip()
+
+	transport.bytes, transport.writes = 0, 0
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		clear := draw(s)
+		term.Draw(s.GetDelta(), clear)
+		s.Flip()
+	}
+
+	b.ReportMetric(float64(transport.bytes) / float64(b.N), "bytes/op")
+	b.ReportMetric(float64(transport.writes) / float64(b.N), "writes/op")
+}
+
+func BenchmarkEncode(b *testing.B) {
+	b.Run("redraw", func(b *testing.B) {
+		benchmarkDraw(b, func(s Screen) bool {
+			s.Invalidate()
+			return true
+		})
+	})
+
+	// The player steps onto the next tile and back.
+	b.Run("move", func(b *testing.B) {
+		x, y := 40, 12
+		benchmarkDraw(b, func(s Screen) bool {
+			s.GoTo(x, y)
+			s.SetStyle(DefaultStyle)
+			s.Put('.')
+			x = 81 - x
+			s.GoTo(x, y)
+			s.Put('@')
+			return false
+		})
+	})
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"container/list"
+	"errors"
 	"log"
 	"math/rand"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 type Map interface {
@@ -42,21 +45,40 @@ func MakeMap(width, height int) Map {
 	return m
 }
 
+// The map the world is loaded from.
+const worldMapFile = "world/map.txt"
+
 func MakeMapFromFile(filename string) Map {
-	file, err := os.Open(filename)
+	m, err := LoadMapFromFile(filename)
 	if err != nil {
 		log.Fatal(err)
 		return nil
 	}
 
+	return m
+}
+
+// LoadMapFromFile reads a map with one line of tiles per row.
+func LoadMapFromFile(filename string) (Map, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
 	m := &map2D{}
 	data := make([]string, 0, 100)
 
-	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
 		data = append(data, scanner.Text())
 	}
 
 	file.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if len(data) == 0 || len(data[0]) == 0 {
+		return nil, errors.New(filename + ": empty map")
+	}
 
 	m.width, m.height = len(data[0]), len(data)	
 	m.tiles = make([]byte, m.width * m.height)
@@ -65,7 +87,7 @@ func MakeMapFromFile(filename string) Map {
 		copy(m.tiles[r * m.width:], []byte(data[r]))
 	}
 
-	return m
+	return m, nil
 }
 
 func (m *map2D) GetSize() (int, int) {
@@ -95,41 +117,58 @@ func (m *map2D) GetRow(x, y, width int, b []byte) int {
 
 // Game.
 
+// The game state is owned by a single goroutine that runs the game loop.
+// Entities, the map and the chat service may only be touched from that
+// goroutine, that is from entity callbacks or from functions passed to
+// Post or Synchronize.  Other goroutines hand work to the loop with those
+// two methods.
 type Game interface {
 	GetMap() Map
+	SetMap(m Map)
 	GetEntities() map[Entity]bool
-	CreatePlayer(t Telnet) PlayerEntity
+	FindPlayer(name string) PlayerEntity
+	CreatePlayer(t Terminal, name string) PlayerEntity
+	JoinPlayer(t Terminal, name string) (PlayerEntity, bool)
+	DisconnectPlayer(p PlayerEntity, t Terminal)
 	AddEntity(e Entity)
 	RemoveEntity(e Entity)
-	SleepEntity(e Entity, d time.Duration)
+	Post(f func())
+	Synchronize(f func())
 	Update()
 	Start()
 	Stop()
 	GetChat() ChatService
+
+	// CountPlayers returns how many players are in the world.  Unlike
+	// the rest of the game, it may be used from any goroutine.
+	CountPlayers() int
+
+	// removeEntity removes an entity at once.  It may only be used on
+	// the game goroutine.
+	removeEntity(e Entity)
 }
 
 type game struct {
 	worldMap		Map
 	chatService		ChatService
 	entities		map[Entity]bool
-	activeEntities		map[Entity]bool
-	sleepingEntities	map[Entity]bool
-	delayedActions		[]func()
+	players			map[string]PlayerEntity
+	playerCount		int64
+	scheduler		*scheduler
+	actions			chan func()
 	quit			chan bool
 	done			chan bool
-	entityLock		sync.Locker
 }
 
 func MakeGame() Game {
-	g := &game{worldMap: MakeMapFromFile("world/map.txt"),
+	g := &game{worldMap: MakeMapFromFile(worldMapFile),
 		chatService: CreateChatService(),
 		entities: make(map[Entity]bool),
-		activeEntities: make(map[Entity]bool),
-		sleepingEntities: make(map[Entity]bool),
-		delayedActions: make([]func(), 0, 128),
+		players: make(map[string]PlayerEntity),
+		scheduler: makeScheduler(),
+		actions: make(chan func(), 256),
 		quit: make(chan bool),
-		done: make(chan bool),
-		entityLock: &sync.Mutex{}}
+		done: make(chan bool)}
 
 	for i := 0; i < 10; i++ {
 		dx, dy := randomSpawnPoint()
@@ -144,10 +183,49 @@ func (g *game) GetMap() Map {
 	return g.worldMap
 }
 
+// GetEntities returns the live set of entities.  It may only be used on
+// the game goroutine.
 func (g *game) GetEntities() map[Entity]bool {
 	return g.entities
 }
 
+// SetMap replaces the world map, which must have an open spawn point.
+// Entities left outside it or inside a wall are moved to one.  It may
+// only be used on the game goroutine.
+func (g *game) SetMap(m Map) {
+	g.worldMap = m
+
+	for e := range g.entities {
+		if x, y := e.GetPosition(); !isOpen(m, x, y) {
+			x, y, _ = findSpawnPoint(m)
+			e.SetPosition(x, y)
+		}
+	}
+}
+
+// FindPlayer returns the player of a user, or nil if they are not in the
+// world.  It may only be used on the game goroutine.
+func (g *game) FindPlayer(name string) PlayerEntity {
+	return g.players[name]
+}
+
+// tileAt returns the tile at a position.  The world is surrounded by
+// water.
+func tileAt(m Map, x, y int) byte {
+	w, h := m.GetSize()
+	if x < 0 || x >= w || y < 0 || y >= h {
+		return '~'
+	}
+
+	return m.GetTile(x, y)
+}
+
+// isOpen reports whether a position is on the map and can be walked on.
+func isOpen(m Map, x, y int) bool {
+	tile := tileAt(m, x, y)
+	return tile != '~' && tile != '#'
+}
+
 func randomSpawnPoint() (int, int) {
 	minX, maxX, minY, maxY := 0, 0, 0, 0
 	switch rand.Intn(3) {
@@ -171,94 +249,205 @@ func randomSpawnPoint() (int, int) {
 	return minX + rand.Intn(maxX - minX), minY + rand.Intn(maxY - minY)
 }
 
-func (g *game) CreatePlayer(t Telnet) PlayerEntity {
-	p := &playerEntity{commands: make([]Command, 0, 8),
+// findSpawnPoint returns a spawn point that is open on a map, if it can
+// find one.
+func findSpawnPoint(m Map) (int, int, bool) {
+	for i := 0; i < 100; i++ {
+		if x, y := randomSpawnPoint(); isOpen(m, x, y) {
+			return x, y, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// A named rectangular area of the world.
+type zone struct {
+	name		string
+	x0, y0, x1, y1	int
+}
+
+var zones = []zone{
+	{"the Keep", 40, 9, 52, 16},
+	{"the Bridge", 35, 25, 41, 28},
+	{"the Village", 33, 34, 45, 40},
+	{"the Docks", 9, 36, 31, 46},
+}
+
+// zoneAt returns the name of the zone containing a position.
+func zoneAt(x, y int) string {
+	for _, z := range zones {
+		if x >= z.x0 && x < z.x1 && y >= z.y0 && y < z.y1 {
+			return z.name
+		}
+	}
+
+	return "the Wilds"
+}
+
+// CreatePlayer adds a new player for a user to the world on the next
+// tick.
+func (g *game) CreatePlayer(t Terminal, name string) PlayerEntity {
+	p := makePlayer(g, t, name)
+	g.AddEntity(p)
+	return p
+}
+
+func makePlayer(g *game, t Terminal, name string) *playerEntity {
+	p := &playerEntity{keys: make([]KeyEvent, 0, 8),
+		name: name,
+		lastInput: time.Now().UnixNano(),
 		owner: g,
-		screen: MakeScreen(80, 24),
-		telnet: t,
+		terminal: t,
 		commandLock: &sync.Mutex{},
+		bindings: DefaultKeyBindings(),
+		gmcpSent: make(map[string][]byte),
+		lineMode: t.GetLineMode(),
 		chatting: false}
 	
 	p.x, p.y = randomSpawnPoint()
 
-	p.chatBox = p.screen.MakeRegion(25, 23, 55, 1)
-	p.chatBuffer = make([]byte, 0, 128)
-	p.chatArea = p.screen.MakeRegion(25, 0, 55, 23)
+	p.layout(80, 24)
+	p.chatBuffer = make([]rune, 0, 128)
 	p.chatHistory = list.New()
 
-	g.AddEntity(p)
 	return p
 }
 
+// AddEntity adds an entity to the world on the next tick.
 func (g *game) AddEntity(e Entity) {
-	g.entityLock.Lock()
-	defer g.entityLock.Unlock()
+	g.Post(func() {
+		g.addEntity(e)
+	})
+}
 
+func (g *game) addEntity(e Entity) {
 	g.entities[e] = true
-	g.activeEntities[e] = true
+	g.scheduler.Add(e)
 	e.Initialize()
+
+	if p, ok := e.(PlayerEntity); ok {
+		g.players[p.GetName()] = p
+		atomic.AddInt64(&g.playerCount, 1)
+		g.chatService.Announce(p.GetName() + " has entered the world.")
+	}
 }
 
+// RemoveEntity removes an entity from the world on the next tick.
 func (g *game) RemoveEntity(e Entity) {
-	g.entityLock.Lock()
-	defer g.entityLock.Unlock()
+	g.Post(func() {
+		g.removeEntity(e)
+	})
+}
+
+func (g *game) removeEntity(e Entity) {
+	if !g.entities[e] {
+		return
+	}
 
 	e.Terminate()
 	delete(g.entities, e)
-	delete(g.activeEntities, e)
-	delete(g.sleepingEntities, e)
-}
-
-func (g *game) SleepEntity(e Entity, d time.Duration) {
-	g.delayedActions = append(g.delayedActions,
-		func() {
-			// Move the entity from the active list to the
-			// sleeping list.
-			delete(g.activeEntities, e)
-			g.sleepingEntities[e] = true
-
-			go func() {
-				select {
-				case <-time.After(d):
-					g.entityLock.Lock()
-					delete(g.sleepingEntities, e)
-					g.activeEntities[e] = true
-					g.entityLock.Unlock()
-				}
-			}()
-		})
-}
+	g.scheduler.Remove(e)
 
-func (g *game) Update() {
-	g.entityLock.Lock()
-	
-	for e, _ := range g.activeEntities {
-		e.Update()
+	if p, ok := e.(PlayerEntity); ok {
+		if g.players[p.GetName()] == p {
+			delete(g.players, p.GetName())
+		}
+		atomic.AddInt64(&g.playerCount, -1)
+		g.chatService.Announce(p.GetName() + " has left the world.")
 	}
+}
 
-	for e, _ := range g.entities {
-		e.PostUpdate()
-	}
+// JoinPlayer puts a user into the world on a terminal and returns their
+// player, and whether it was already in the world.  A link-dead player
+// gets the terminal.  A user who is still playing elsewhere takes the
+// player over from the other connection if TakeOverSessions is set, and
+// is refused with a nil player if not.
+func (g *game) JoinPlayer(t Terminal, name string) (player PlayerEntity, resumed bool) {
+	g.Synchronize(func() {
+		p, ok := g.players[name]
+		switch {
+		case !ok:
+			player = makePlayer(g, t, name)
+			g.addEntity(player)
+		case p.IsLinkDead():
+			p.Attach(t)
+			player, resumed = p, true
+		case TakeOverSessions:
+			p.TakeOver(t)
+			player, resumed = p, true
+		}
+	})
+
+	return
+}
 
-	g.entityLock.Unlock()
+// DisconnectPlayer is called when a player's connection on terminal t
+// ends.  The player either stays in the world link-dead or is removed on
+// the next tick.  Connections whose player was taken over are ignored.
+func (g *game) DisconnectPlayer(p PlayerEntity, t Terminal) {
+	g.Post(func() {
+		if !g.entities[p] || p.GetTerminal() != t {
+			return
+		}
+
+		if !p.Detach() {
+			g.removeEntity(p)
+		}
+	})
+}
 
-	for _, f := range g.delayedActions {
+// Post queues f to run on the game goroutine at the start of the next
+// tick.  Functions run in the order they were posted.
+func (g *game) Post(f func()) {
+	g.actions <- f
+}
+
+// Synchronize runs f on the game goroutine and waits for it to finish.
+// It must not be called from the game goroutine itself.
+func (g *game) Synchronize(f func()) {
+	done := make(chan bool)
+	g.Post(func() {
 		f()
+		done <- true
+	})
+	<-done
+}
+
+// runActions runs everything posted since the last tick.
+func (g *game) runActions() {
+	for {
+		select {
+		case f := <-g.actions:
+			f()
+		default:
+			return
+		}
 	}
+}
+
+func (g *game) Update() {
+	g.runActions()
+
+	g.scheduler.Tick()
 
-	g.delayedActions = g.delayedActions[:0]
+	for e, _ := range g.entities {
+		e.PostUpdate()
+	}
 }
 
 func (g *game) run() {
 	defer func() { g.done <- true }()
 
+	ticker := time.NewTicker(TickDuration)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <- g.quit:
 			return
-		default:
+		case <- ticker.C:
 			g.Update()
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
 }
@@ -274,6 +463,10 @@ func (g *game) Stop() {
 	log.Printf("Game stopped\n")
 }
 
+func (g *game) CountPlayers() int {
+	return int(atomic.LoadInt64(&g.playerCount))
+}
+
 func (g *game) GetChat() ChatService {
 	return g.chatService
 }
@@ -282,40 +475,64 @@ func (g *game) GetChat() ChatService {
 
 type Entity interface {
 	Initialize()
-	Update()
+	Act(energy int) int
 	PostUpdate()
 	Terminate()
 	GetPosition() (int, int)
 	SetPosition(x, y int)
-	GetAppearance() byte
-}
-
-type Command []byte
-
-func MakeCommand(b []byte) Command {
-	cmd := make(Command, len(b))
-	copy(cmd, b)
-	return cmd
+	GetAppearance() rune
+	GetSpeed() int
 }
 
 type PlayerEntity interface {
 	Entity
-	AddCommand(command Command)
-	SetName(name string)
+	AddKey(key KeyEvent)
+	SetKeyBindings(b KeyBindings)
 	GetName() string
+	GetIdleTime() time.Duration
+	SetInventory(items []InventoryItem)
+	SetTextMode(on bool)
+	GetTerminal() Terminal
+	Notify(message string)
+	Kick(reason string)
+	Attach(t Terminal)
+	TakeOver(t Terminal)
+	Detach() bool
+	IsLinkDead() bool
 }
 
 type playerEntity struct {
 	x, y	 	int
 	name		string
-	commands	[]Command
+	keys		[]KeyEvent
+	lastInput	int64
 	owner		Game
 	screen		Screen
-	telnet		Telnet
+	mapView		Region
+	glyphs		GlyphSet
+	caps		Capabilities
+	terminal	Terminal
+	output		*sessionWriter
+	redraw		bool
+	termWidth	int
+	termHeight	int
 	commandLock	sync.Locker
+	bindings	KeyBindings
+	energy		int
+	inventory	[]InventoryItem
+	gmcpSent	map[string][]byte
+	gmcpChat	[]gmcpPackage
+	textMode	bool
+	lineMode	bool
+	text		[]byte
+	idleWarned	bool
+	kicked		bool
+	removed		bool
+	linkDead	bool
+	linkDeadSince	time.Time
 
 	chatBox		Region
-	chatBuffer	[]byte
+	chatBuffer	[]rune
 	chatting	bool
 	chatArea	Region
 	chatHistory	*list.List
@@ -323,120 +540,277 @@ type playerEntity struct {
 
 func (p *playerEntity) onChat(o Entity, m string) {
 	p.chatHistory.PushBack(m)
-	if p.chatHistory.Len() >= 25 {
+	if p.chatHistory.Len() > maxScreenHeight {
 		p.chatHistory.Remove(p.chatHistory.Front())
 	}
+	p.printLine(m)
+
+	if p.terminal.GetCapabilities().GMCP && len(p.gmcpChat) < 25 {
+		p.gmcpChat = append(p.gmcpChat, chatPackage(o, m))
+	}
+}
+
+// Notify is notify for use outside the player, such as by the console.
+// It may only be used on the game goroutine.
+func (p *playerEntity) Notify(m string) {
+	p.notify(m)
+}
+
+// notify shows a message to this player only.
+func (p *playerEntity) notify(m string) {
+	p.onChat(nil, m)
 }
 
 func (p *playerEntity) Initialize() {
+	p.output = makeSessionWriter(p.terminal)
 	p.owner.GetChat().Register(p, p.onChat)
 }
 
-func (p *playerEntity) Update() {
+// Act processes queued keys.  Keys that only affect the player's own
+// view, such as typing in the chat box, are free; the rest must wait
+// until the player has enough energy.  In line mode keys make up lines
+// of commands instead.
+func (p *playerEntity) Act(energy int) int {
 	p.commandLock.Lock()
 	defer p.commandLock.Unlock()
 
-	m := p.owner.GetMap()
-
-	for _, c := range p.commands {
-		x, y := p.x, p.y
-		
-		switch len(c) {
-		case 3:
-			switch c[2] {
-			case 'C':
-				x = x + 1
-			case 'A':
-				y = y - 1
-			case 'D':
-				x = x - 1
-			case 'B':
-				y = y + 1
-			}
-		case 2:
-			if c[0] == '\r' && c[1] == '\n' {
-				p.owner.GetChat().Send(p, p.GetName() + ": " + string(p.chatBuffer))
-				p.chatBuffer = p.chatBuffer[:0]
+	spent, n := 0, 0
+	for _, k := range p.keys {
+		if p.lineMode {
+			a := p.lineAction(k)
+			if actionCost(a) > 0 && energy - spent < ActionThreshold {
+				break
 			}
-		case 1:
-			buf := p.chatBuffer
-			bufLen := len(buf)
 
-			// Escape.
-			if c[0] == 27 {
-				p.chatBuffer = p.chatBuffer[:0]
-			}
+			spent += p.handleLineKey(k, a)
+			n++
+			continue
+		}
 
-			// Backspace.
-			if (c[0] == 127 || c[0] == 8) && bufLen > 0 {
-				p.chatBuffer = p.chatBuffer[:bufLen - 1]
-			}
-				
-			// Printable character.
-			if c[0] >= 32 && c[0] != 127 && len(buf) < cap(buf) {
-				p.chatBuffer = append(p.chatBuffer, c[0])
-			}
+		if p.bindings[k] == ActionRedraw {
+			p.redraw = true
+			n++
+			continue
 		}
 
-		if m.GetTile(x, y) == '~' || m.GetTile(x, y) == '#' {
+		if p.chatting {
+			p.handleChatKey(k)
+			n++
 			continue
 		}
 
+		a := p.bindings[k]
+		cost := actionCost(a)
+		if cost > 0 && energy - spent < ActionThreshold {
+			break
+		}
+
+		spent += p.handleAction(a)
+		n++
+	}
+
+	p.keys = p.keys[:copy(p.keys, p.keys[n:])]
+	p.energy = energy - spent
+	return spent
+}
+
+// actionCost returns the energy an action needs.
+func actionCost(a Action) int {
+	if _, ok := actionDirections[a]; ok {
+		return MoveCost
+	}
+
+	return 0
+}
+
+// handleAction performs an action bound to a key in movement mode and
+// returns the energy it used.  Bumping into a wall is free.
+func (p *playerEntity) handleAction(a Action) int {
+	switch a {
+	case ActionChat:
+		p.chatting = true
+		p.echo("> ")
+	case ActionCommand:
+		p.chatting = true
+		p.chatBuffer = append(p.chatBuffer[:0], '/')
+		p.echo("> /")
+	}
+
+	if d, ok := actionDirections[a]; ok {
+		x, y := p.x + d[0], p.y + d[1]
+
+		if m := p.owner.GetMap(); !isOpen(m, x, y) {
+			p.blocked(tileAt(m, x, y), d[0], d[1])
+			return 0
+		}
+
 		p.x, p.y = x, y
+		p.moved(x - d[0], y - d[1])
+		return actionCost(a)
+	}
+
+	return 0
+}
+
+// handleChatKey edits the chat line.  Enter sends it and Escape abandons
+// it; either way the player returns to movement mode.
+func (p *playerEntity) handleChatKey(k KeyEvent) {
+	switch k.Key {
+	case KeyEnter, KeyPadEnter:
+		p.echo("\r\n")
+		p.chatting = false
+		if len(p.chatBuffer) > 0 && p.chatBuffer[0] == '/' {
+			runChatCommand(p, string(p.chatBuffer))
+		} else if len(p.chatBuffer) > 0 {
+			p.owner.GetChat().Send(p, p.GetName() + ": " + string(p.chatBuffer))
+		}
+		p.chatBuffer = p.chatBuffer[:0]
+	case KeyEscape:
+		p.echo("\r\n")
+		p.chatBuffer = p.chatBuffer[:0]
+		p.chatting = false
+	case KeyBackspace:
+		if bufLen := len(p.chatBuffer); bufLen > 0 {
+			p.chatBuffer = p.chatBuffer[:bufLen - 1]
+			p.echo("\b \b")
+		}
+	case KeyRune:
+		buf := p.chatBuffer
+		if k.Mod & (ModCtrl | ModAlt) == 0 && unicode.IsPrint(k.Rune) && len(buf) < cap(buf) {
+			p.chatBuffer = append(p.chatBuffer, k.Rune)
+			p.echo(string(k.Rune))
+		}
+	}
+}
+
+// SetKeyBindings replaces the keys used in movement mode.
+func (p *playerEntity) SetKeyBindings(b KeyBindings) {
+	p.commandLock.Lock()
+	defer p.commandLock.Unlock()
+
+	p.bindings = b
+}
+
+// Limits on the size of the screen.  Smaller terminals see part of it,
+// larger ones get no more than this.
+const (
+	minScreenWidth	= 20
+	minScreenHeight	= 8
+	maxScreenWidth	= 250
+	maxScreenHeight	= 100
+)
+
+// layout makes a screen the size of the terminal and places the map and
+// the chat on it: side by side when there is room, stacked otherwise.
+// An unknown size is taken to be 80x24.
+func (p *playerEntity) layout(w, h int) {
+	if w <= 0 || h <= 0 {
+		w, h = 80, 24
+	}
+	w = Maxi(minScreenWidth, Mini(w, maxScreenWidth))
+	h = Maxi(minScreenHeight, Mini(h, maxScreenHeight))
+
+	s := MakeScreen(w, h)
+	if w >= 60 {
+		side := Mini(h, w - 36)
+		p.mapView = s.MakeRegion(0, 0, side, h)
+		p.chatArea = s.MakeRegion(side + 1, 0, w - side - 1, h - 1)
+		p.chatBox = s.MakeRegion(side + 1, h - 1, w - side - 1, 1)
+	} else {
+		chatLines := Maxi(3, h / 4)
+		p.mapView = s.MakeRegion(0, 0, w, h - chatLines - 1)
+		p.chatArea = s.MakeRegion(0, h - chatLines - 1, w, chatLines)
+		p.chatBox = s.MakeRegion(0, h - 1, w, 1)
 	}
 
-	p.commands = p.commands[:0]
+	p.screen = s
+	p.glyphs = SelectGlyphSet(p.caps)
 }
 
+// PostUpdate draws the player's view and hands any changes to the
+// session writer.  Nothing is drawn while the client is behind.
 func (p *playerEntity) PostUpdate() {
-	s := p.screen
-	m := p.owner.GetMap()
-	mw, mh := m.GetSize()
-	buffer := make([]byte, 512)
+	if p.linkDead {
+		p.checkLinkDead()
+		return
+	}
 
-	// Compute visible rectangle.
-	viewSize := 24
-	x0, y0 := p.x - viewSize / 2, p.y - viewSize / 2
-	
-	ox, oy := 0, 0
-	if x0 < 0 {
-		ox = -x0
-		x0 = 0
+	p.checkIdle()
+	if p.kicked {
+		defer p.output.Disconnect("")
 	}
-	if y0 < 0 {
-		oy = -y0
-		y0 = 0
+
+	if !p.output.Ready() {
+		return
 	}
 
-	x1, y1 := Mini(mw, x0 + viewSize), Mini(mh, y0 + viewSize)
-	_, vh := x1 - x0, y1 - y0
+	if p.textMode {
+		p.postText()
+		return
+	}
 
-	// Draw the world.
-	s.Clear(0, 0, viewSize, viewSize, '~')
-	for r := 0; r < vh - oy; r++ {
-		n := m.GetRow(x0, y0 + r, mw, buffer)
-		s.GoTo(ox, oy + r)
-		overflow := ox + n - viewSize
-		s.Write(buffer[:Mini(n - overflow, n)])
+	// Redraw everything when asked to or when the terminal changed,
+	// since either way it may no longer show what was sent.
+	w, h := p.terminal.GetSize()
+	caps := p.terminal.GetCapabilities()
+	if w != p.termWidth || h != p.termHeight || caps != p.caps {
+		p.termWidth, p.termHeight, p.caps = w, h, caps
+		p.layout(w, h)
+		p.redraw = true
+	}
+
+	s := p.screen
+	if p.redraw {
+		s.Invalidate()
+		p.output.Redraw()
+		p.redraw = false
+	}
+
+	// Draw the world around the player, with water beyond its edges.
+	m := p.owner.GetMap()
+	mw, mh := m.GetSize()
+	vw, vh := p.mapView.GetSize()
+	x0, y0 := p.x - vw / 2, p.y - vh / 2
+
+	for r := 0; r < vh; r++ {
+		p.mapView.GoTo(0, r)
+		for c := 0; c < vw; c++ {
+			tile := '~'
+			if x, y := x0 + c, y0 + r; x >= 0 && x < mw && y >= 0 && y < mh {
+				tile = rune(m.GetTile(x, y))
+			}
+
+			g := p.glyphs.Get(tile)
+			p.mapView.SetStyle(g.Style)
+			p.mapView.Put(g.Char)
+		}
 	}
 
 	// Draw world entities visible to the player.
-	entities := p.owner.GetEntities()
-	for e := range entities {
+	for e := range p.owner.GetEntities() {
 		x, y := e.GetPosition()
-		x, y = ox + x - x0, oy + y - y0
-		if x < 0 || x >= viewSize || y < 0 || y >= viewSize {
+		x, y = x - x0, y - y0
+		if x < 0 || x >= vw || y < 0 || y >= vh {
 			continue
 		}
-		s.GoTo(x, y)
-		s.Put(e.GetAppearance())
+
+		g := p.glyphs.Get(e.GetAppearance())
+		p.mapView.SetStyle(g.Style)
+		p.mapView.GoTo(x, y)
+		p.mapView.Put(g.Char)
 	}
+	s.SetStyle(DefaultStyle)
 
 	// Draw chat area.
-	w, h := p.chatBox.GetSize()
+	w, h = p.chatBox.GetSize()
 	p.chatBox.Clear(0, 0, w, h, ' ')
 	p.chatBox.GoTo(0, 0)
-	p.chatBox.Write(p.chatBuffer[Maxi(0, len(p.chatBuffer) - 55):])
+	if p.chatting {
+		p.chatBox.Write([]byte("> "))
+		p.chatBox.Put(p.chatBuffer[Maxi(0, len(p.chatBuffer) - (w - 2)):]...)
+	} else {
+		p.chatBox.Write([]byte("Press Enter to chat"))
+	}
 
 	w, h = p.chatArea.GetSize()
 	p.chatArea.Clear(0, 0, w, h, ' ')
@@ -453,20 +827,27 @@ func (p *playerEntity) PostUpdate() {
 		r--
 	}
 
-	delta := s.GetDelta()
-
-	for _, d := range delta {
-		d.Apply(p.telnet)
+	var packages []gmcpPackage
+	if p.caps.GMCP {
+		packages = p.gmcpPackages()
 	}
 
+	p.output.Send(s.GetDelta(), packages)
 	s.Flip()
 }
 
+// Terminate saves where the player left the world.
 func (p *playerEntity) Terminate() {
+	p.removed = true
+	go theDatabase.SetPosition(p.name, p.x, p.y)
+
 	p.owner.GetChat().Unregister(p)
+	if p.output != nil {
+		p.closeOutput()
+	}
 }
 
-func (p playerEntity) GetPosition() (int, int) {
+func (p *playerEntity) GetPosition() (int, int) {
 	return p.x, p.y
 }
 
@@ -475,25 +856,52 @@ func (p *playerEntity) SetPosition(x, y int) {
 	p.y = y
 }
 
-func (p playerEntity) GetAppearance() byte {
+func (p *playerEntity) GetAppearance() rune {
 	return '@'
 }
 
-func (p *playerEntity) AddCommand(command Command) {
+func (*playerEntity) GetSpeed() int {
+	return PlayerSpeed
+}
+
+func (p *playerEntity) AddKey(key KeyEvent) {
 	p.commandLock.Lock()
 	defer p.commandLock.Unlock()
 
-	p.commands = append(p.commands, command)
+	limit := maxQueuedKeys
+	if p.lineMode {
+		limit = maxQueuedLineKeys
+	}
+
+	if len(p.keys) < limit {
+		p.keys = append(p.keys, key)
+	}
+	atomic.StoreInt64(&p.lastInput, time.Now().UnixNano())
+}
+
+// SetInventory replaces what the player is carrying.  It may be called
+// from any goroutine.
+func (p *playerEntity) SetInventory(items []InventoryItem) {
+	p.owner.Post(func() {
+		p.inventory = items
+	})
 }
 
-func (p *playerEntity) SetName(name string) {
-	p.name = name
+// GetIdleTime returns how long ago the player last sent any input.
+func (p *playerEntity) GetIdleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&p.lastInput))
 }
 
-func (p playerEntity) GetName() string {
+func (p *playerEntity) GetName() string {
 	return p.name
 }
 
+// GetTerminal returns the terminal the player is played on, or was until
+// they lost the link.
+func (p *playerEntity) GetTerminal() Terminal {
+	return p.terminal
+}
+
 
 // Dog entity.
 
@@ -510,7 +918,11 @@ func MakeDog(x, y int, g Game) Entity {
 func (*dog) Initialize() {
 }
 
-func (d *dog) Update() {
+func (d *dog) Act(energy int) int {
+	if energy < ActionThreshold {
+		return 0
+	}
+
 	x, y := d.x, d.y
 	switch rand.Int31n(4) {
 	case 0:
@@ -523,13 +935,12 @@ func (d *dog) Update() {
 		y -= 1
 	}
 
-	if m := d.owner.GetMap(); m.GetTile(x, y) == '~' || m.GetTile(x, y) == '#' {
-		return
+	if !isOpen(d.owner.GetMap(), x, y) {
+		return 0
 	}
 
 	d.x, d.y = x, y
-
-	d.owner.SleepEntity(d, time.Second)
+	return MoveCost
 }
 
 func (*dog) PostUpdate() {
@@ -546,7 +957,10 @@ func (d *dog) SetPosition(x, y int) {
 	d.x, d.y = x, y
 }
 
-func (dog) GetAppearance() byte {
+func (dog) GetAppearance() rune {
 	return 'd'
 }
 
+func (dog) GetSpeed() int {
+	return DogSpeed
+}
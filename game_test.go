@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testDatabase has no users' settings and forgets what is saved.
+type testDatabase struct {
+	Database
+}
+
+func (testDatabase) GetKeyBindings(name string) map[string]string {
+	return nil
+}
+
+func (testDatabase) SetKeyBinding(name string, key string, action string) error {
+	return nil
+}
+
+func (testDatabase) GetInventory(name string) []InventoryItem {
+	return nil
+}
+
+func (testDatabase) GetScreenReader(name string) bool {
+	return false
+}
+
+func (testDatabase) GetPosition(name string) (int, int, bool) {
+	return 0, 0, false
+}
+
+func (testDatabase) SetPosition(name string, x, y int) {
+}
+
+// startTestGame starts a fast game with the test database.  The game is
+// stopped and the globals put back when the test is done.
+func startTestGame(t *testing.T) Game {
+	database, writer, game, tick := theDatabase, theDatabaseWriter, theGame, TickDuration
+	theDatabase = testDatabase{}
+	theDatabaseWriter = MakeDatabaseWriter()
+	TickDuration = time.Millisecond
+
+	g := MakeGame()
+	g.Start()
+	theGame = g
+
+	t.Cleanup(func() {
+		g.Stop()
+		theDatabaseWriter.Close()
+		theDatabase, theDatabaseWriter, theGame, TickDuration = database, writer, game, tick
+	})
+	return g
+}
+
+// restoreDuration sets a duration for a test, putting it back once the
+// test and its game are done.
+func restoreDuration(t *testing.T, d *time.Duration, value time.Duration) {
+	saved := *d
+	*d = value
+	t.Cleanup(func() { *d = saved })
+}
+
+func discardLog(format string, v ...interface{}) {
+}
+
+// waitForPlayer waits for a user to enter the world.
+func waitForPlayer(t *testing.T, g Game, name string) PlayerEntity {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var p PlayerEntity
+		g.Synchronize(func() {
+			p = g.FindPlayer(name)
+		})
+		if p != nil {
+			return p
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Errorf("%s never entered the world", name)
+	return nil
+}
+
+var arrowKeys = []KeyEvent{{Key: KeyUp}, {Key: KeyRight}, {Key: KeyDown}, {Key: KeyLeft}}
+
+// TestManyPlayers runs sessions for many players at once, moving them
+// around and logging them out.
+func TestManyPlayers(t *testing.T) {
+	restoreDuration(t, &LinkDeadTimeout, 0)
+	g := startTestGame(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			term := MakeMemoryTerminal(80, 24)
+			done := make(chan bool)
+			go func() {
+				runSession(term, name, discardLog)
+				close(done)
+			}()
+
+			p := waitForPlayer(t, g, name)
+			if p == nil {
+				term.Close()
+				<-done
+				return
+			}
+
+			for j := 0; j < 100; j++ {
+				term.SendKeys(arrowKeys[(j / 5) % len(arrowKeys)])
+				if j % 20 == 0 {
+					g.Synchronize(func() {
+						if x, y := p.GetPosition(); !isOpen(g.GetMap(), x, y) {
+							t.Errorf("%s is at %d, %d, which is not open ground", name, x, y)
+						}
+						if p.GetTerminal() != term {
+							t.Errorf("%s lost their terminal", name)
+						}
+					})
+				}
+			}
+
+			term.Close()
+			<-done
+
+			g.Synchronize(func() {
+				if g.FindPlayer(name) != nil || g.GetEntities()[p] {
+					t.Errorf("%s is still in the world after logging out", name)
+				}
+			})
+		}(fmt.Sprintf("player%d", i))
+	}
+	wg.Wait()
+}
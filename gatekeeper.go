@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on what a single address may do.  They can be changed from the
+// command line; zero turns a limit off.
+var (
+	// How many connections an address may have open at once.
+	MaxConnectionsPerIP	= 5
+
+	// How long a client waits before trying again after a wrong password.
+	// The wait doubles with every failure, up to MaxLoginBackoff.
+	LoginBackoff		= time.Second
+	MaxLoginBackoff		= time.Minute
+
+	// How many wrong passwords an address may send before it is locked
+	// out, and for how long.
+	MaxLoginFailures	= 5
+	LockoutDuration		= 15 * time.Minute
+)
+
+var (
+	errBanned		= errors.New("your address is banned")
+	errTooManyConnections	= errors.New("too many connections from your address")
+	errLockedOut		= errors.New("too many failed logins, try again later")
+)
+
+// A Gatekeeper decides which addresses may connect and log in.  It is
+// safe to use from any goroutine.
+type Gatekeeper interface {
+	Connect(host string) error
+	Disconnect(host string)
+	WaitToLogIn(host string) error
+	LoginFailed(host string)
+	LoginSucceeded(host string)
+	Ban(pattern string) error
+	Unban(pattern string) bool
+	GetBans() []string
+}
+
+// Failed logins from an address.
+type loginFailures struct {
+	count		int
+	last		time.Time
+	lockedUntil	time.Time
+}
+
+type gatekeeper struct {
+	lock		sync.Mutex
+	connections	map[string]int
+	failures	map[string]*loginFailures
+	bans		map[string]*net.IPNet
+	banFile		string
+}
+
+var theGatekeeper Gatekeeper = MakeGatekeeper("")
+
+// MakeGatekeeper creates a gatekeeper that keeps its ban list in a file,
+// one address or CIDR range per line.  With no file name bans are
+// forgotten when the server stops.
+func MakeGatekeeper(banFile string) Gatekeeper {
+	g := &gatekeeper{connections: make(map[string]int),
+		failures: make(map[string]*loginFailures),
+		bans: make(map[string]*net.IPNet),
+		banFile: banFile}
+
+	if banFile == "" {
+		return g
+	}
+
+	data, err := ioutil.ReadFile(banFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return g
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+
+		if network, err := parseBan(line); err != nil {
+			log.Printf("%s: %s", banFile, err.Error())
+		} else {
+			g.bans[network.String()] = network
+		}
+	}
+
+	return g
+}
+
+// remoteHost returns the address part of a remote address, which is
+// what limits and bans apply to.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// parseBan parses an address or a CIDR range.
+func parseBan(pattern string) (*net.IPNet, error) {
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		return network, err
+	}
+
+	ip := net.ParseIP(pattern)
+	if ip == nil {
+		return nil, errors.New("invalid address: " + pattern)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8 * net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Connect admits a new connection from an address, unless the address
+// is banned, locked out or already has too many connections.  Every
+// admitted connection must be ended with Disconnect.
+func (g *gatekeeper) Connect(host string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.isBanned(host) {
+		return errBanned
+	} else if g.isLockedOut(host) {
+		return errLockedOut
+	} else if MaxConnectionsPerIP > 0 && g.connections[host] >= MaxConnectionsPerIP {
+		return errTooManyConnections
+	}
+
+	g.connections[host]++
+	return nil
+}
+
+func (g *gatekeeper) Disconnect(host string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.connections[host]--; g.connections[host] <= 0 {
+		delete(g.connections, host)
+	}
+}
+
+func (g *gatekeeper) isBanned(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range g.bans {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *gatekeeper) isLockedOut(host string) bool {
+	f := g.failures[host]
+	return f != nil && time.Now().Before(f.lockedUntil)
+}
+
+// WaitToLogIn holds up a login attempt from an address that has recently
+// sent wrong passwords, longer for every one of them.  It fails if the
+// address is locked out.
+func (g *gatekeeper) WaitToLogIn(host string) error {
+	g.lock.Lock()
+	if g.isLockedOut(host) {
+		g.lock.Unlock()
+		return errLockedOut
+	}
+
+	var wait time.Duration
+	if f := g.failures[host]; f != nil && f.count > 0 {
+		wait = loginDelay(f.count) - time.Since(f.last)
+	}
+	g.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return nil
+}
+
+// loginDelay returns how long a client waits after a number of wrong
+// passwords in a row.
+func loginDelay(failures int) time.Duration {
+	delay := LoginBackoff
+	for i := 1; i < failures && delay > 0 && delay < MaxLoginBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > MaxLoginBackoff {
+		delay = MaxLoginBackoff
+	}
+	return delay
+}
+
+// LoginFailed counts a wrong password from an address and locks it out
+// once it has sent MaxLoginFailures of them.  Failures are forgotten a
+// LockoutDuration after the last one.
+func (g *gatekeeper) LoginFailed(host string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	for h, f := range g.failures {
+		if now.Sub(f.last) > LockoutDuration && now.After(f.lockedUntil) {
+			delete(g.failures, h)
+		}
+	}
+
+	f := g.failures[host]
+	if f == nil {
+		f = &loginFailures{}
+		g.failures[host] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if MaxLoginFailures > 0 && f.count >= MaxLoginFailures {
+		log.Printf("%s: locked out after %d failed logins", host, f.count)
+		f.count = 0
+		f.lockedUntil = now.Add(LockoutDuration)
+	}
+}
+
+func (g *gatekeeper) LoginSucceeded(host string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	delete(g.failures, host)
+}
+
+// Ban refuses connections from an address or CIDR range from now on.
+// Connections already open are not closed.
+func (g *gatekeeper) Ban(pattern string) error {
+	network, err := parseBan(pattern)
+	if err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.bans[network.String()] = network
+	g.saveBans()
+	return nil
+}
+
+// Unban lifts a ban, reporting whether there was one.
+func (g *gatekeeper) Unban(pattern string) bool {
+	network, err := parseBan(pattern)
+	if err != nil {
+		return false
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, ok := g.bans[network.String()]; !ok {
+		return false
+	}
+
+	delete(g.bans, network.String())
+	g.saveBans()
+	return true
+}
+
+// GetBans returns the banned addresses and ranges in order.
+func (g *gatekeeper) GetBans() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.banList()
+}
+
+func (g *gatekeeper) banList() []string {
+	bans := make([]string, 0, len(g.bans))
+	for pattern := range g.bans {
+		bans = append(bans, pattern)
+	}
+	sort.Strings(bans)
+
+	return bans
+}
+
+func (g *gatekeeper) saveBans() {
+	if g.banFile == "" {
+		return
+	}
+
+	data := strings.Join(g.banList(), "\n") + "\n"
+	if err := ioutil.WriteFile(g.banFile, []byte(data), 0644); err != nil {
+		log.Print(err)
+	}
+}
+
+// checkPassword checks a user's password for a client at an address,
+// keeping that address from guessing quickly.
+func checkPassword(db Database, host, name, password string) (bool, error) {
+	if err := theGatekeeper.WaitToLogIn(host); err != nil {
+		return false, err
+	}
+
+	if !db.Authenticate(name, password) {
+		theGatekeeper.LoginFailed(host)
+		return false, nil
+	}
+
+	theGatekeeper.LoginSucceeded(host)
+	return true, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A pipeConn is one end of a net.Pipe that seems to come from an address.
+type pipeConn struct {
+	net.Conn
+	remote	string
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "tcp"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.remote)
+}
+
+// saveLimits returns a function that puts the gatekeeper's limits back
+// the way they are now.
+func saveLimits() func() {
+	connections, backoff, maxBackoff := MaxConnectionsPerIP, LoginBackoff, MaxLoginBackoff
+	failures, lockout, keeper := MaxLoginFailures, LockoutDuration, theGatekeeper
+
+	return func() {
+		MaxConnectionsPerIP, LoginBackoff, MaxLoginBackoff = connections, backoff, maxBackoff
+		MaxLoginFailures, LockoutDuration, theGatekeeper = failures, lockout, keeper
+	}
+}
+
+// refusal connects from an address and returns what the server says
+// before it hangs up.
+func refusal(t *testing.T, host string) string {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	createConnectionHandler(pipeConn{server, host + ":4000"})
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("%s: %s", host, err)
+	}
+
+	return string(data)
+}
+
+func TestConnectionLimit(t *testing.T) {
+	defer saveLimits()()
+	MaxConnectionsPerIP = 2
+	theGatekeeper = MakeGatekeeper("")
+
+	for i := 0; i < 2; i++ {
+		if err := theGatekeeper.Connect("192.0.2.1"); err != nil {
+			t.Fatalf("connection %d refused: %s", i + 1, err)
+		}
+	}
+
+	if err := theGatekeeper.Connect("192.0.2.1"); err != errTooManyConnections {
+		t.Errorf("third connection: got %v, want %v", err, errTooManyConnections)
+	}
+	if message := refusal(t, "192.0.2.1"); message != "Too many connections from your address.\r\n" {
+		t.Errorf("third connection was told %q", message)
+	}
+
+	if err := theGatekeeper.Connect("192.0.2.2"); err != nil {
+		t.Errorf("another address was refused: %s", err)
+	}
+
+	theGatekeeper.Disconnect("192.0.2.1")
+	if err := theGatekeeper.Connect("192.0.2.1"); err != nil {
+		t.Errorf("connection refused after another closed: %s", err)
+	}
+
+	MaxConnectionsPerIP = 0
+	if err := theGatekeeper.Connect("192.0.2.1"); err != nil {
+		t.Errorf("connection refused with no limit: %s", err)
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	defer saveLimits()()
+
+	tests := []struct {
+		backoff, max	time.Duration
+		failures	int
+		want		time.Duration
+	}{
+		{time.Second, time.Minute, 1, time.Second},
+		{time.Second, time.Minute, 2, 2 * time.Second},
+		{time.Second, time.Minute, 6, 32 * time.Second},
+		{time.Second, time.Minute, 7, time.Minute},
+		{time.Second, time.Minute, 100, time.Minute},
+		{time.Second, time.Minute, 1 << 30, time.Minute},
+		{time.Minute, time.Second, 1, time.Second},
+		{0, time.Minute, 1 << 30, 0},
+	}
+
+	for _, test := range tests {
+		LoginBackoff, MaxLoginBackoff = test.backoff, test.max
+		if got := loginDelay(test.failures); got != test.want {
+			t.Errorf("%d failures, backoff %s up to %s: got %s, want %s",
+				test.failures, test.backoff, test.max, got, test.want)
+		}
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	defer saveLimits()()
+	LoginBackoff, MaxLoginBackoff, MaxLoginFailures = 20 * time.Millisecond, 40 * time.Millisecond, 0
+	g := MakeGatekeeper("")
+
+	// Each wait is measured from the last failure.
+	for _, want := range []time.Duration{0, 20, 40, 40} {
+		want *= time.Millisecond
+
+		start := time.Now()
+		if err := g.WaitToLogIn("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited < want - 5 * time.Millisecond || waited > want + time.Second {
+			t.Errorf("waited %s, want %s", waited, want)
+		}
+
+		g.LoginFailed("192.0.2.1")
+	}
+
+	start := time.Now()
+	g.WaitToLogIn("192.0.2.2")
+	if waited := time.Since(start); waited > 10 * time.Millisecond {
+		t.Errorf("another address waited %s", waited)
+	}
+
+	g.LoginSucceeded("192.0.2.1")
+	start = time.Now()
+	g.WaitToLogIn("192.0.2.1")
+	if waited := time.Since(start); waited > 10 * time.Millisecond {
+		t.Errorf("waited %s after logging in", waited)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	defer saveLimits()()
+	LoginBackoff, MaxLoginFailures, LockoutDuration = 0, 3, 50 * time.Millisecond
+	theGatekeeper = MakeGatekeeper("")
+
+	for i := 0; i < 2; i++ {
+		theGatekeeper.LoginFailed("192.0.2.1")
+		if err := theGatekeeper.WaitToLogIn("192.0.2.1"); err != nil {
+			t.Fatalf("locked out after %d failures", i + 1)
+		}
+	}
+
+	theGatekeeper.LoginFailed("192.0.2.1")
+	if err := theGatekeeper.WaitToLogIn("192.0.2.1"); err != errLockedOut {
+		t.Errorf("login: got %v, want %v", err, errLockedOut)
+	}
+	if err := theGatekeeper.Connect("192.0.2.1"); err != errLockedOut {
+		t.Errorf("connection: got %v, want %v", err, errLockedOut)
+	}
+	if message := refusal(t, "192.0.2.1"); message != "Too many failed logins, try again later.\r\n" {
+		t.Errorf("connection was told %q", message)
+	}
+	if err := theGatekeeper.Connect("192.0.2.2"); err != nil {
+		t.Errorf("another address was locked out: %s", err)
+	}
+
+	time.Sleep(LockoutDuration + 10 * time.Millisecond)
+	if err := theGatekeeper.WaitToLogIn("192.0.2.1"); err != nil {
+		t.Errorf("still locked out after %s: %s", LockoutDuration, err)
+	}
+
+	// The lockout starts the count again.
+	theGatekeeper.LoginFailed("192.0.2.1")
+	if err := theGatekeeper.WaitToLogIn("192.0.2.1"); err != nil {
+		t.Errorf("locked out again after one failure")
+	}
+}
+
+func TestBans(t *testing.T) {
+	defer saveLimits()()
+
+	f, err := ioutil.TempFile("", "bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	theGatekeeper = MakeGatekeeper(f.Name())
+	for _, pattern := range []string{"10.1.0.0/16", "192.0.2.7", "2001:db8::/32"} {
+		if err := theGatekeeper.Ban(pattern); err != nil {
+			t.Fatalf("%s: %s", pattern, err)
+		}
+	}
+	if err := theGatekeeper.Ban("10.1.0.0/99"); err == nil {
+		t.Error("an invalid range was banned")
+	}
+	if err := theGatekeeper.Ban("example.com"); err == nil {
+		t.Error("a host name was banned")
+	}
+
+	banned := map[string]bool{
+		"10.1.0.1":		true,
+		"10.1.255.255":		true,
+		"10.2.0.1":		false,
+		"192.0.2.7":		true,
+		"192.0.2.8":		false,
+		"2001:db8::1":		true,
+		"2001:db9::1":		false,
+	}
+	for host, want := range banned {
+		if err := theGatekeeper.Connect(host); (err == errBanned) != want {
+			t.Errorf("%s: got %v, banned %v", host, err, want)
+		} else if err == nil {
+			theGatekeeper.Disconnect(host)
+		}
+	}
+	if message := refusal(t, "10.1.2.3"); message != "Your address is banned.\r\n" {
+		t.Errorf("banned address was told %q", message)
+	}
+
+	// The bans are kept in the file.
+	want := []string{"10.1.0.0/16", "192.0.2.7/32", "2001:db8::/32"}
+	reloaded := MakeGatekeeper(f.Name())
+	if bans := reloaded.GetBans(); !reflect.DeepEqual(bans, want) {
+		t.Errorf("reloaded bans: got %v, want %v", bans, want)
+	}
+
+	// Any address in a range names it.
+	if !reloaded.Unban("10.1.2.3/16") {
+		t.Error("could not unban 10.1.0.0/16")
+	}
+	if reloaded.Unban("10.1.0.0/16") {
+		t.Error("unbanned 10.1.0.0/16 twice")
+	}
+	if err := reloaded.Connect("10.1.0.1"); err != nil {
+		t.Errorf("10.1.0.1 is still refused: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "10.1.0.0/16") {
+		t.Errorf("ban file still has the lifted ban: %q", data)
+	}
+}
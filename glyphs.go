@@ -0,0 +1,91 @@
+package main
+
+// How a map tile or an entity is shown.
+type Glyph struct {
+	Char	rune
+	Style	Style
+}
+
+// A GlyphSet maps tiles and entity appearances to what is drawn for them.
+type GlyphSet map[rune]Glyph
+
+func fg(c Color) Style {
+	return Style{c, ColorDefault}
+}
+
+// ASCIIGlyphs draws everything as itself, in color where the terminal
+// has any.
+var ASCIIGlyphs = GlyphSet{
+	'~':	{'~', fg(RGB(0x30, 0x60, 0xd0))},
+	'#':	{'#', fg(RGB(0xa0, 0xa0, 0xa0))},
+	'.':	{'.', fg(RGB(0xb0, 0x98, 0x70))},
+	',':	{',', fg(RGB(0x40, 0xa0, 0x40))},
+	'`':	{'`', fg(RGB(0x20, 0x70, 0x20))},
+	'=':	{'=', fg(RGB(0x8b, 0x5a, 0x2b))},
+	'|':	{'|', fg(RGB(0x8b, 0x5a, 0x2b))},
+	'/':	{'/', fg(RGB(0x8b, 0x5a, 0x2b))},
+	'\\':	{'\\', fg(RGB(0x8b, 0x5a, 0x2b))},
+	'o':	{'o', fg(RGB(0xc0, 0xc0, 0x40))},
+	'x':	{'x', fg(RGB(0xc0, 0x40, 0x40))},
+	'@':	{'@', fg(RGB(0xff, 0xff, 0x60))},
+	'd':	{'d', fg(RGB(0xc0, 0x80, 0x40))},
+}
+
+// Get returns the glyph for a tile or appearance, falling back to the
+// character itself.
+func (g GlyphSet) Get(r rune) Glyph {
+	if glyph, ok := g[r]; ok {
+		return glyph
+	}
+
+	return Glyph{r, DefaultStyle}
+}
+
+// derive returns a copy of a glyph set with some characters replaced,
+// keeping their styles.
+func (g GlyphSet) derive(chars map[rune]rune) GlyphSet {
+	d := make(GlyphSet, len(g))
+	for r, glyph := range g {
+		if c, ok := chars[r]; ok {
+			glyph.Char = c
+		}
+		d[r] = glyph
+	}
+
+	return d
+}
+
+// UnicodeGlyphs uses box drawing and symbols for terminals with UTF-8.
+var UnicodeGlyphs = ASCIIGlyphs.derive(map[rune]rune{
+	'~':	'≈',
+	'#':	'▓',
+	'.':	'·',
+	'`':	'♣',
+	'=':	'═',
+	'|':	'│',
+	'/':	'╱',
+	'\\':	'╲',
+	'o':	'○',
+	'x':	'×',
+})
+
+// CP437Glyphs uses what the IBM PC character set has of the same.
+var CP437Glyphs = ASCIIGlyphs.derive(map[rune]rune{
+	'~':	'≈',
+	'#':	'▓',
+	'.':	'·',
+	'=':	'═',
+	'|':	'│',
+})
+
+// SelectGlyphSet returns the glyphs to draw with on a terminal.
+func SelectGlyphSet(c Capabilities) GlyphSet {
+	switch c.Charset() {
+	case CharsetUTF8:
+		return UnicodeGlyphs
+	case CharsetCP437:
+		return CP437Glyphs
+	}
+
+	return ASCIIGlyphs
+}
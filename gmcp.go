@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+)
+
+// GMCP carries JSON packages out of band, alongside the screen, so that
+// MUD clients can show the player's state in their own widgets.  Each
+// message is a package name followed by a space and a JSON value, sent in
+// a subnegotiation.
+
+// A package to be sent to a client.
+type gmcpPackage struct {
+	name	string
+	data	[]byte
+}
+
+// makePackage encodes a package.  Values that cannot be encoded are
+// programming errors and are logged.
+func makePackage(name string, v interface{}) gmcpPackage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return gmcpPackage{name, data}
+}
+
+// SendPackage sends a GMCP message if the client has agreed to GMCP.
+func (tc *TelnetData) SendPackage(name string, data []byte) {
+	if !tc.GetCapabilities().GMCP {
+		return
+	}
+
+	b := make([]byte, 0, len(name) + len(data) + 6)
+	b = append(b, TelnetIac, TelnetSb, TelnetGmcp)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, bytes.Replace(data, []byte{TelnetIac}, []byte{TelnetIac, TelnetIac}, -1)...)
+	b = append(b, TelnetIac, TelnetSe)
+
+	tc.Write(b)
+}
+
+// handleGmcp handles a message from the client.  Clients introduce
+// themselves and list the packages they want, but every package is sent
+// regardless, so these are only logged.
+func (tc *TelnetData) handleGmcp(data []byte) {
+	name, payload := string(data), ""
+	if i := bytes.IndexByte(data, ' '); i >= 0 {
+		name, payload = string(data[:i]), string(data[i + 1:])
+	}
+
+	switch name {
+	case "Core.Hello", "Core.Supports.Set", "Core.Supports.Add":
+		log.Printf("%s: %s %s", tc.conn.RemoteAddr().String(), name, payload)
+	}
+}
+
+// gmcpPackages returns the packages describing the player that changed
+// since they were last sent, followed by any chat messages.
+func (p *playerEntity) gmcpPackages() []gmcpPackage {
+	mode := "move"
+	if p.chatting {
+		mode = "chat"
+	}
+
+	items := make([]map[string]interface{}, 0, len(p.inventory))
+	for _, item := range p.inventory {
+		items = append(items, map[string]interface{}{
+			"id": strconv.Itoa(item.Id),
+			"name": item.Name,
+			"count": item.Count})
+	}
+
+	state := []gmcpPackage{
+		makePackage("Char.Vitals", map[string]int{
+			"energy": p.energy,
+			"maxenergy": ActionThreshold}),
+		makePackage("Char.Status", map[string]string{
+			"name": p.name,
+			"mode": mode}),
+		makePackage("Room.Info", map[string]interface{}{
+			"zone": zoneAt(p.x, p.y),
+			"x": p.x,
+			"y": p.y,
+			"terrain": string(p.owner.GetMap().GetTile(p.x, p.y))}),
+		makePackage("Char.Items.List", map[string]interface{}{
+			"location": "inv",
+			"items": items}),
+	}
+
+	packages := make([]gmcpPackage, 0, len(state) + len(p.gmcpChat))
+	for _, pkg := range state {
+		if !bytes.Equal(p.gmcpSent[pkg.name], pkg.data) {
+			p.gmcpSent[pkg.name] = pkg.data
+			packages = append(packages, pkg)
+		}
+	}
+
+	packages = append(packages, p.gmcpChat...)
+	p.gmcpChat = p.gmcpChat[:0]
+
+	return packages
+}
+
+// chatPackage describes a chat message for the client's chat window.
+func chatPackage(o Entity, m string) gmcpPackage {
+	msg := map[string]string{"channel": "system", "text": m}
+	if player, ok := o.(PlayerEntity); ok {
+		msg["channel"] = "say"
+		msg["talker"] = player.GetName()
+	}
+
+	return makePackage("Comm.Channel.Text", msg)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A key on the keyboard.  KeyRune stands for any key that produces a
+// character, which is then stored in KeyEvent.Rune.
+type Key int
+
+const (
+	KeyRune Key = iota
+	KeyEnter
+	KeyTab
+	KeyBackspace
+	KeyEscape
+	KeyUp
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyBegin
+	KeyHome
+	KeyEnd
+	KeyInsert
+	KeyDelete
+	KeyPageUp
+	KeyPageDown
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+	KeyPad0
+	KeyPad1
+	KeyPad2
+	KeyPad3
+	KeyPad4
+	KeyPad5
+	KeyPad6
+	KeyPad7
+	KeyPad8
+	KeyPad9
+	KeyPadEnter
+)
+
+var keyNames = map[Key]string{
+	KeyEnter:	"Enter",
+	KeyTab:		"Tab",
+	KeyBackspace:	"Backspace",
+	KeyEscape:	"Escape",
+	KeyUp:		"Up",
+	KeyDown:	"Down",
+	KeyRight:	"Right",
+	KeyLeft:	"Left",
+	KeyBegin:	"Begin",
+	KeyHome:	"Home",
+	KeyEnd:		"End",
+	KeyInsert:	"Insert",
+	KeyDelete:	"Delete",
+	KeyPageUp:	"PageUp",
+	KeyPageDown:	"PageDown",
+	KeyPadEnter:	"KPEnter",
+}
+
+func init() {
+	for k := KeyF1; k <= KeyF12; k++ {
+		keyNames[k] = "F" + strconv.Itoa(int(k - KeyF1) + 1)
+	}
+	for k := KeyPad0; k <= KeyPad9; k++ {
+		keyNames[k] = "KP" + strconv.Itoa(int(k - KeyPad0))
+	}
+}
+
+func (k Key) String() string {
+	if name, ok := keyNames[k]; ok {
+		return name
+	}
+
+	return "Rune"
+}
+
+// Modifier keys held while a key was pressed.
+type Modifier int
+
+const (
+	ModShift Modifier = 1 << iota
+	ModAlt
+	ModCtrl
+)
+
+// A single key press decoded from the input stream.
+type KeyEvent struct {
+	Key	Key
+	Rune	rune
+	Mod	Modifier
+}
+
+func (e KeyEvent) String() string {
+	prefix := ""
+	if e.Mod & ModCtrl != 0 {
+		prefix += "C-"
+	}
+	if e.Mod & ModAlt != 0 {
+		prefix += "M-"
+	}
+	if e.Mod & ModShift != 0 {
+		prefix += "S-"
+	}
+
+	if e.Key == KeyRune {
+		if e.Rune == ' ' {
+			return prefix + "Space"
+		}
+		return prefix + string(e.Rune)
+	}
+
+	return prefix + e.Key.String()
+}
+
+// The longest escape sequence we are willing to buffer.  Anything longer
+// is treated as garbage.
+const maxEscapeLength = 32
+
+// A KeyDecoder turns a stream of bytes from a terminal into key events.
+// Escape sequences and UTF-8 characters may be split across calls to
+// Feed; incomplete input is kept until more bytes arrive or Flush is
+// called.
+type KeyDecoder struct {
+	pending		[]byte
+	afterReturn	bool
+}
+
+// Feed decodes as much of the input as possible and returns the keys
+// that were completed.
+func (d *KeyDecoder) Feed(b []byte) []KeyEvent {
+	d.pending = append(d.pending, b...)
+	events := make([]KeyEvent, 0, len(d.pending))
+
+	i := 0
+	for i < len(d.pending) {
+		n, e, ok := d.decode(d.pending[i:])
+		if n == 0 {
+			break
+		}
+
+		if ok {
+			events = append(events, e)
+		}
+		i += n
+	}
+
+	d.pending = append(d.pending[:0], d.pending[i:]...)
+	return events
+}
+
+// Pending reports whether an incomplete sequence is waiting for more
+// input.
+func (d *KeyDecoder) Pending() bool {
+	return len(d.pending) > 0
+}
+
+// Flush gives up waiting for the rest of a pending sequence.  A lone
+// escape byte becomes the Escape key; partial UTF-8 becomes the
+// replacement character.
+func (d *KeyDecoder) Flush() []KeyEvent {
+	if len(d.pending) == 0 {
+		return nil
+	}
+
+	pending := d.pending
+	d.pending = nil
+
+	if pending[0] != TelnetEsc {
+		return []KeyEvent{{Key: KeyRune, Rune: utf8.RuneError}}
+	}
+
+	events := []KeyEvent{{Key: KeyEscape}}
+	events = append(events, d.Feed(pending[1:])...)
+	events = append(events, d.Flush()...)
+
+	return events
+}
+
+// decode decodes a single key from the start of b.  It returns the number
+// of bytes consumed, which is zero if the key is incomplete, and whether
+// the bytes produced a key at all.
+func (d *KeyDecoder) decode(b []byte) (int, KeyEvent, bool) {
+	afterReturn := d.afterReturn
+	d.afterReturn = false
+
+	c := b[0]
+	switch {
+	case c == TelnetEsc:
+		return d.decodeEscape(b)
+	case c == '\r':
+		d.afterReturn = true
+		return 1, KeyEvent{Key: KeyEnter}, true
+	case c == '\n' || c == 0:
+		// Telnet sends a return as CR LF or CR NUL.
+		if afterReturn || c == 0 {
+			return 1, KeyEvent{}, false
+		}
+		return 1, KeyEvent{Key: KeyEnter}, true
+	case c == '\t':
+		return 1, KeyEvent{Key: KeyTab}, true
+	case c == 127 || c == 8:
+		return 1, KeyEvent{Key: KeyBackspace}, true
+	case c < 32:
+		return 1, KeyEvent{Key: KeyRune, Rune: rune('a' + c - 1), Mod: ModCtrl}, true
+	case c < utf8.RuneSelf:
+		return 1, KeyEvent{Key: KeyRune, Rune: rune(c)}, true
+	}
+
+	if !utf8.FullRune(b) {
+		return 0, KeyEvent{}, false
+	}
+
+	r, n := utf8.DecodeRune(b)
+	return n, KeyEvent{Key: KeyRune, Rune: r}, true
+}
+
+// decodeEscape decodes a key starting with an escape byte.
+func (d *KeyDecoder) decodeEscape(b []byte) (int, KeyEvent, bool) {
+	if len(b) < 2 {
+		return 0, KeyEvent{}, false
+	}
+
+	switch b[1] {
+	case '[':
+		return d.decodeCsi(b)
+	case 'O':
+		return d.decodeSs3(b)
+	case TelnetEsc:
+		return 1, KeyEvent{Key: KeyEscape}, true
+	}
+
+	// Alt sends the key prefixed with an escape.
+	n, e, ok := d.decode(b[1:])
+	if n == 0 {
+		return 0, KeyEvent{}, false
+	}
+
+	e.Mod |= ModAlt
+	return n + 1, e, ok
+}
+
+var csiFinalKeys = map[byte]Key{
+	'A':	KeyUp,
+	'B':	KeyDown,
+	'C':	KeyRight,
+	'D':	KeyLeft,
+	'E':	KeyBegin,
+	'F':	KeyEnd,
+	'H':	KeyHome,
+	'P':	KeyF1,
+	'Q':	KeyF2,
+	'R':	KeyF3,
+	'S':	KeyF4,
+	'Z':	KeyTab,
+}
+
+var csiTildeKeys = map[int]Key{
+	1:	KeyHome,
+	2:	KeyInsert,
+	3:	KeyDelete,
+	4:	KeyEnd,
+	5:	KeyPageUp,
+	6:	KeyPageDown,
+	7:	KeyHome,
+	8:	KeyEnd,
+	11:	KeyF1,
+	12:	KeyF2,
+	13:	KeyF3,
+	14:	KeyF4,
+	15:	KeyF5,
+	17:	KeyF6,
+	18:	KeyF7,
+	19:	KeyF8,
+	20:	KeyF9,
+	21:	KeyF10,
+	23:	KeyF11,
+	24:	KeyF12,
+}
+
+// decodeCsi decodes a control sequence of the form ESC [ params final.
+func (d *KeyDecoder) decodeCsi(b []byte) (int, KeyEvent, bool) {
+	// The Linux console sends F1-F5 as ESC [ [ A through ESC [ [ E.
+	if len(b) > 2 && b[2] == '[' {
+		if len(b) < 4 {
+			return 0, KeyEvent{}, false
+		}
+		if b[3] >= 'A' && b[3] <= 'E' {
+			return 4, KeyEvent{Key: KeyF1 + Key(b[3] - 'A')}, true
+		}
+		return 4, KeyEvent{}, false
+	}
+
+	end := 2
+	for end < len(b) && b[end] >= 0x20 && b[end] <= 0x3f {
+		end++
+	}
+
+	if end == len(b) {
+		if end >= maxEscapeLength {
+			return end, KeyEvent{}, false
+		}
+		return 0, KeyEvent{}, false
+	}
+
+	final := b[end]
+	n := end + 1
+	if final < 0x40 || final > 0x7e {
+		// Not a valid sequence; drop the introducer and carry on.
+		return 2, KeyEvent{}, false
+	}
+
+	params := strings.Split(string(b[2:end]), ";")
+	mod := parseModifier(params)
+
+	if final == '~' {
+		code, _ := strconv.Atoi(params[0])
+		key, ok := csiTildeKeys[code]
+		return n, KeyEvent{Key: key, Mod: mod}, ok
+	}
+
+	key, ok := csiFinalKeys[final]
+	if final == 'Z' {
+		mod |= ModShift
+	}
+
+	return n, KeyEvent{Key: key, Mod: mod}, ok
+}
+
+var ss3Keys = map[byte]Key{
+	'A':	KeyUp,
+	'B':	KeyDown,
+	'C':	KeyRight,
+	'D':	KeyLeft,
+	'E':	KeyBegin,
+	'F':	KeyEnd,
+	'H':	KeyHome,
+	'M':	KeyPadEnter,
+	'P':	KeyF1,
+	'Q':	KeyF2,
+	'R':	KeyF3,
+	'S':	KeyF4,
+	'p':	KeyPad0,
+	'q':	KeyPad1,
+	'r':	KeyPad2,
+	's':	KeyPad3,
+	't':	KeyPad4,
+	'u':	KeyPad5,
+	'v':	KeyPad6,
+	'w':	KeyPad7,
+	'x':	KeyPad8,
+	'y':	KeyPad9,
+}
+
+// ss3Runes are keypad keys in application mode that produce characters.
+var ss3Runes = map[byte]rune{
+	'j':	'*',
+	'k':	'+',
+	'l':	',',
+	'm':	'-',
+	'n':	'.',
+	'o':	'/',
+	'X':	'=',
+}
+
+// decodeSs3 decodes a sequence of the form ESC O [modifier] final, used
+// for F1-F4 and the keypad in application mode.
+func (d *KeyDecoder) decodeSs3(b []byte) (int, KeyEvent, bool) {
+	end := 2
+	for end < len(b) && b[end] >= '0' && b[end] <= '9' {
+		end++
+	}
+
+	if end == len(b) {
+		if end >= maxEscapeLength {
+			return end, KeyEvent{}, false
+		}
+		return 0, KeyEvent{}, false
+	}
+
+	mod := parseModifier([]string{"1", string(b[2:end])})
+	n := end + 1
+
+	if key, ok := ss3Keys[b[end]]; ok {
+		return n, KeyEvent{Key: key, Mod: mod}, true
+	}
+	if r, ok := ss3Runes[b[end]]; ok {
+		return n, KeyEvent{Key: KeyRune, Rune: r, Mod: mod}, true
+	}
+
+	return n, KeyEvent{}, false
+}
+
+// parseModifier reads the xterm modifier parameter, which is one more
+// than a bit mask of shift, alt and ctrl.
+func parseModifier(params []string) Modifier {
+	if len(params) < 2 {
+		return 0
+	}
+
+	m, err := strconv.Atoi(params[1])
+	if err != nil || m < 1 {
+		return 0
+	}
+
+	m--
+	mod := Modifier(0)
+	if m & 1 != 0 {
+		mod |= ModShift
+	}
+	if m & 2 != 0 {
+		mod |= ModAlt
+	}
+	if m & 4 != 0 {
+		mod |= ModCtrl
+	}
+
+	return mod
+}
+
+// How long to wait for the rest of an escape sequence before deciding
+// that the escape key itself was pressed.
+const escapeTimeout = 100 * time.Millisecond
+
+var errReadTimeout = errors.New("timed out waiting for input")
+
+// A KeyReader reads key events from a telnet connection.
+type KeyReader struct {
+	decoder		KeyDecoder
+	reads		chan []byte
+	done		chan bool
+	closeOnce	sync.Once
+	events		[]KeyEvent
+	err		error
+	timeout		time.Duration
+}
+
+// MakeKeyReader creates a reader that decodes all input from a
+// connection.  Nothing else may read from the connection afterwards.
+func MakeKeyReader(t io.Reader) *KeyReader {
+	r := &KeyReader{reads: make(chan []byte, 4), done: make(chan bool)}
+
+	go func() {
+		defer close(r.reads)
+
+		buffer := make([]byte, 512)
+		for {
+			n, err := t.Read(buffer)
+			if err != nil {
+				r.err = err
+				return
+			}
+
+			data := make([]byte, n)
+			copy(data, buffer)
+
+			select {
+			case r.reads <- data:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// SetTimeout limits how long ReadKey waits for input.  Zero means no
+// limit.  It must be called from the goroutine that reads keys.
+func (r *KeyReader) SetTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// ReadKey blocks until a key is pressed, the connection fails or the
+// timeout passes without any input.
+func (r *KeyReader) ReadKey() (KeyEvent, error) {
+	var idle <-chan time.Time
+	if r.timeout > 0 {
+		timer := time.NewTimer(r.timeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	for len(r.events) == 0 {
+		var timeout <-chan time.Time
+		if r.decoder.Pending() {
+			timeout = time.After(escapeTimeout)
+		}
+
+		select {
+		case data, ok := <-r.reads:
+			if !ok {
+				return KeyEvent{}, r.err
+			}
+			r.events = r.decoder.Feed(data)
+		case <-timeout:
+			r.events = r.decoder.Flush()
+		case <-idle:
+			return KeyEvent{}, errReadTimeout
+		}
+	}
+
+	e := r.events[0]
+	r.events = r.events[1:]
+	return e, nil
+}
+
+// Close stops reading from the connection.  It may be called more than
+// once.
+func (r *KeyReader) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestLongEscapeSequence sends escape sequences that never end.  They
+// must be dropped once they grow past maxEscapeLength instead of kept
+// waiting for more input.
+func TestLongEscapeSequence(t *testing.T) {
+	for _, introducer := range []string{"\x1b[", "\x1bO"} {
+		var d KeyDecoder
+		d.Feed([]byte(introducer))
+
+		chunk := bytes.Repeat([]byte{'1'}, 1024)
+		for i := 0; i < 1024; i++ {
+			d.Feed(chunk)
+			if len(d.pending) > maxEscapeLength {
+				t.Fatalf("%q: %d bytes pending", introducer, len(d.pending))
+			}
+		}
+
+		events := d.Feed([]byte("\x1b[A"))
+		if n := len(events); n == 0 || events[n - 1].Key != KeyUp {
+			t.Errorf("%q: got %v after the sequence, want Up last", introducer, events)
+		}
+	}
+}
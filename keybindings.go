@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Something a player can do by pressing a key outside of chat entry.
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionNorth
+	ActionNorthEast
+	ActionEast
+	ActionSouthEast
+	ActionSouth
+	ActionSouthWest
+	ActionWest
+	ActionNorthWest
+	ActionChat
+	ActionCommand
+	ActionRedraw
+
+	numActions
+)
+
+var actionNames = map[Action]string{
+	ActionNone:		"none",
+	ActionNorth:		"north",
+	ActionNorthEast:	"northeast",
+	ActionEast:		"east",
+	ActionSouthEast:	"southeast",
+	ActionSouth:		"south",
+	ActionSouthWest:	"southwest",
+	ActionWest:		"west",
+	ActionNorthWest:	"northwest",
+	ActionChat:		"chat",
+	ActionCommand:		"command",
+	ActionRedraw:		"redraw",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// ParseAction returns the action with the given name.
+func ParseAction(name string) (Action, bool) {
+	for a, n := range actionNames {
+		if strings.EqualFold(n, name) {
+			return a, true
+		}
+	}
+
+	return ActionNone, false
+}
+
+// actionDirections maps movement actions to their offsets.
+var actionDirections = map[Action][2]int{
+	ActionNorth:		{0, -1},
+	ActionNorthEast:	{1, -1},
+	ActionEast:		{1, 0},
+	ActionSouthEast:	{1, 1},
+	ActionSouth:		{0, 1},
+	ActionSouthWest:	{-1, 1},
+	ActionWest:		{-1, 0},
+	ActionNorthWest:	{-1, -1},
+}
+
+// ParseKeyEvent is the inverse of KeyEvent.String, turning names such as
+// "h", "C-l", "S-Up" or "KP7" back into keys.
+func ParseKeyEvent(name string) (KeyEvent, bool) {
+	e := KeyEvent{}
+
+	for len(name) > 2 && name[1] == '-' {
+		switch name[0] {
+		case 'C':
+			e.Mod |= ModCtrl
+		case 'M':
+			e.Mod |= ModAlt
+		case 'S':
+			e.Mod |= ModShift
+		default:
+			return e, false
+		}
+		name = name[2:]
+	}
+
+	if utf8.RuneCountInString(name) == 1 {
+		e.Key = KeyRune
+		e.Rune, _ = utf8.DecodeRuneInString(name)
+		return e, true
+	}
+
+	if name == "Space" {
+		e.Key = KeyRune
+		e.Rune = ' '
+		return e, true
+	}
+
+	for k, n := range keyNames {
+		if strings.EqualFold(n, name) {
+			e.Key = k
+			return e, true
+		}
+	}
+
+	return e, false
+}
+
+// Maps keys to the actions they trigger.
+type KeyBindings map[KeyEvent]Action
+
+// DefaultKeyBindings returns the bindings every account starts with:
+// arrow keys, vi-keys and the numeric keypad for movement, and Enter to
+// start typing.  Ctrl-L redraws the screen in either mode.
+func DefaultKeyBindings() KeyBindings {
+	b := make(KeyBindings)
+
+	bind := func(a Action, keys ...KeyEvent) {
+		for _, k := range keys {
+			b[k] = a
+		}
+	}
+	r := func(c rune) KeyEvent {
+		return KeyEvent{Key: KeyRune, Rune: c}
+	}
+	k := func(key Key) KeyEvent {
+		return KeyEvent{Key: key}
+	}
+
+	bind(ActionNorth, k(KeyUp), r('k'), r('8'), k(KeyPad8))
+	bind(ActionSouth, k(KeyDown), r('j'), r('2'), k(KeyPad2))
+	bind(ActionEast, k(KeyRight), r('l'), r('6'), k(KeyPad6))
+	bind(ActionWest, k(KeyLeft), r('h'), r('4'), k(KeyPad4))
+	bind(ActionNorthWest, r('y'), r('7'), k(KeyPad7), k(KeyHome))
+	bind(ActionNorthEast, r('u'), r('9'), k(KeyPad9), k(KeyPageUp))
+	bind(ActionSouthWest, r('b'), r('1'), k(KeyPad1), k(KeyEnd))
+	bind(ActionSouthEast, r('n'), r('3'), k(KeyPad3), k(KeyPageDown))
+	bind(ActionChat, k(KeyEnter), k(KeyPadEnter))
+	bind(ActionCommand, r('/'))
+	bind(ActionRedraw, KeyEvent{Key: KeyRune, Rune: 'l', Mod: ModCtrl})
+
+	return b
+}
+
+// LoadKeyBindings returns the default bindings overridden by any the
+// user has saved.
+func LoadKeyBindings(db Database, name string) KeyBindings {
+	b := DefaultKeyBindings()
+
+	for keyName, actionName := range db.GetKeyBindings(name) {
+		key, ok := ParseKeyEvent(keyName)
+		if !ok {
+			log.Printf("%s: ignoring binding for unknown key %s", name, keyName)
+			continue
+		}
+
+		action, ok := ParseAction(actionName)
+		if !ok {
+			log.Printf("%s: ignoring unknown action %s", name, actionName)
+			continue
+		}
+
+		b[key] = action
+	}
+
+	return b
+}
+
+// opensChat reports whether an action starts typing in the chat box.
+func opensChat(a Action) bool {
+	return a == ActionChat || a == ActionCommand
+}
+
+// isChatKey reports whether a key does something while typing in the
+// chat box, so that it cannot also be bound to an action that works in
+// either mode.
+func isChatKey(k KeyEvent) bool {
+	switch k.Key {
+	case KeyEnter, KeyPadEnter, KeyEscape, KeyBackspace:
+		return true
+	case KeyRune:
+		return k.Mod & (ModCtrl | ModAlt) == 0 && unicode.IsPrint(k.Rune)
+	}
+
+	return false
+}
+
+// CheckBinding returns why a key cannot be bound to an action, or nil if
+// it can.  Chat keys cannot redraw the screen, and the last key that
+// opens chat cannot be taken away.
+func (b KeyBindings) CheckBinding(k KeyEvent, a Action) error {
+	if a == ActionRedraw && isChatKey(k) {
+		return fmt.Errorf("%s is needed for typing in chat", k)
+	}
+
+	if !opensChat(b[k]) || opensChat(a) {
+		return nil
+	}
+
+	for other, action := range b {
+		if other != k && opensChat(action) {
+			return nil
+		}
+	}
+
+	return errors.New(k.String() + " is the last key that opens chat")
+}
+
+// Describe lists the bindings as "key=action" pairs sorted by action.
+func (b KeyBindings) Describe() []string {
+	byAction := make(map[Action][]string)
+	for k, a := range b {
+		if a != ActionNone {
+			byAction[a] = append(byAction[a], k.String())
+		}
+	}
+
+	lines := make([]string, 0, len(byAction))
+	for a := ActionNorth; a < numActions; a++ {
+		keys := byAction[a]
+		if len(keys) == 0 {
+			continue
+		}
+
+		sort.Strings(keys)
+		lines = append(lines, a.String() + ": " + strings.Join(keys, " "))
+	}
+
+	return lines
+}
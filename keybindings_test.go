@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckBinding(t *testing.T) {
+	enter := KeyEvent{Key: KeyEnter}
+	padEnter := KeyEvent{Key: KeyPadEnter}
+	slash := KeyEvent{Key: KeyRune, Rune: '/'}
+
+	tests := []struct {
+		name	string
+		unbound	[]KeyEvent
+		key	string
+		action	Action
+		ok	bool
+	}{
+		{"move with a letter", nil, "x", ActionNorth, true},
+		{"redraw with a letter", nil, "x", ActionRedraw, false},
+		{"redraw with Space", nil, "Space", ActionRedraw, false},
+		{"redraw with Escape", nil, "Escape", ActionRedraw, false},
+		{"redraw with a control key", nil, "C-r", ActionRedraw, true},
+		{"redraw with a function key", nil, "F5", ActionRedraw, true},
+		{"unbind one chat key", nil, "Enter", ActionNone, true},
+		{"unbind the last chat key", []KeyEvent{padEnter, slash}, "Enter", ActionNone, false},
+		{"move with the last chat key", []KeyEvent{enter, padEnter}, "/", ActionWest, false},
+		{"move the last chat key", []KeyEvent{enter, padEnter}, "/", ActionChat, true},
+		{"unbind the last chat key but one", []KeyEvent{padEnter}, "Enter", ActionNone, true},
+	}
+
+	for _, test := range tests {
+		b := DefaultKeyBindings()
+		for _, k := range test.unbound {
+			b[k] = ActionNone
+		}
+
+		key, ok := ParseKeyEvent(test.key)
+		if !ok {
+			t.Fatalf("%s: unknown key %s", test.name, test.key)
+		}
+
+		if err := b.CheckBinding(key, test.action); (err == nil) != test.ok {
+			t.Errorf("%s: CheckBinding = %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+}
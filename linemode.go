@@ -0,0 +1,263 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Line mode is for clients that cannot address the cursor: dumb
+// terminals, telnet clients that never report a size and raw netcat.
+// Such players log in by answering prompts and play in text mode, typing
+// one command per line.
+
+// How long to give a client to describe its terminal before deciding
+// that it cannot.
+const negotiationTimeout = time.Second
+
+// Terminal types that cannot address the cursor.
+var dumbTerminals = []string{"DUMB", "UNKNOWN"}
+
+// isDumbTerminal reports whether a terminal seems unable to address the
+// cursor: it has not reported a size or calls itself dumb.  A client that
+// reports a size but no terminal type is given the benefit of the doubt.
+func isDumbTerminal(term Terminal) bool {
+	if w, h := term.GetSize(); w <= 0 || h <= 0 {
+		return true
+	}
+
+	t := strings.ToUpper(term.GetCapabilities().TerminalType)
+	for _, name := range dumbTerminals {
+		if t == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitForTerminal gives a client time to report its size and terminal
+// type, returning as soon as it has.
+func waitForTerminal(term Terminal) {
+	watcher, ok := term.(terminalWatcher)
+	if !ok {
+		return
+	}
+
+	timeout := time.After(negotiationTimeout)
+	for !isTerminalDescribed(term) {
+		select {
+		case <-watcher.TerminalChanged():
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// isTerminalDescribed reports whether a client has reported both its size
+// and its terminal type.
+func isTerminalDescribed(term Terminal) bool {
+	w, h := term.GetSize()
+	return w > 0 && h > 0 && term.GetCapabilities().TerminalType != ""
+}
+
+// doLineAuthentication is doAuthentication for terminals in line mode.
+func doLineAuthentication(term Terminal, host string) (bool, string) {
+	writeLine := func(s string) {
+		term.Write([]byte(s + "\r\n"))
+	}
+
+	prompt := func(s string, n int) (string, error) {
+		term.Write([]byte(s))
+		return readLine(term, false, n)
+	}
+
+	for _, line := range title {
+		writeLine(line)
+	}
+	writeLine("")
+
+	createAccount := func() error {
+		for {
+			name, err := prompt("Choose a user name: ", 16)
+			if err != nil {
+				return err
+			}
+
+			if name == "" {
+				continue
+			} else if theDatabase.UserExists(name) {
+				writeLine("User already exists")
+				continue
+			}
+
+			password, err := prompt("Password: ", 64)
+			if err != nil {
+				return err
+			}
+
+			if len(password) == 0 {
+				writeLine("I'd prefer a longer password")
+				continue
+			}
+
+			repeatPassword, err := prompt("Repeat Password: ", 64)
+			if err != nil {
+				return err
+			}
+
+			if password != repeatPassword {
+				writeLine("Passwords do not match")
+				continue
+			}
+
+			email, err := prompt("E-Mail for password recovery: ", 254)
+			if err != nil {
+				return err
+			}
+
+			if success, _ := theDatabase.CreateUser(name, password, email); success {
+				writeLine("Account created, you can log in now.")
+			} else {
+				writeLine("Account creation failed!")
+			}
+
+			return nil
+		}
+	}
+
+	for {
+		name, err := prompt("User name, or \"new\" to create an account: ", 16)
+		if err != nil {
+			return false, ""
+		}
+
+		switch name {
+		case "":
+			continue
+		case "new":
+			if err := createAccount(); err != nil {
+				return false, ""
+			}
+			continue
+		}
+
+		password, err := prompt("Password: ", 64)
+		if err != nil {
+			return false, ""
+		}
+
+		authenticated, err := checkPassword(theDatabase, host, name, password)
+		if err != nil {
+			writeLine(capitalize(err.Error()))
+			return false, ""
+		} else if authenticated {
+			return true, name
+		}
+
+		writeLine("Invalid credentials")
+	}
+}
+
+// Words that move the player in line mode.
+var lineDirections = map[string]Action{
+	"n":	ActionNorth,
+	"ne":	ActionNorthEast,
+	"e":	ActionEast,
+	"se":	ActionSouthEast,
+	"s":	ActionSouth,
+	"sw":	ActionSouthWest,
+	"w":	ActionWest,
+	"nw":	ActionNorthWest,
+}
+
+var lineCommands map[string]chatCommand
+
+func init() {
+	lineCommands = map[string]chatCommand{
+		"look":		doLook,
+		"l":		doLook,
+		"where":	doWhere,
+		"say":		doSay,
+		"help":		doLineHelp,
+	}
+
+	for a := range actionDirections {
+		lineDirections[a.String()] = a
+	}
+}
+
+// lineAction returns the move made by a key that ends a line, if the
+// line is a direction.
+func (p *playerEntity) lineAction(k KeyEvent) Action {
+	if k.Key != KeyEnter && k.Key != KeyPadEnter {
+		return ActionNone
+	}
+
+	return lineDirections[strings.ToLower(strings.TrimSpace(string(p.chatBuffer)))]
+}
+
+// handleLineKey collects a line in line mode and carries it out when it
+// ends, returning the energy it used.  a is the line's lineAction.  The
+// client echoes what is typed.
+func (p *playerEntity) handleLineKey(k KeyEvent, a Action) int {
+	switch k.Key {
+	case KeyEnter, KeyPadEnter:
+		line := strings.TrimSpace(string(p.chatBuffer))
+		p.chatBuffer = p.chatBuffer[:0]
+
+		if a != ActionNone {
+			return p.handleAction(a)
+		}
+		runLineCommand(p, line)
+	case KeyBackspace:
+		if bufLen := len(p.chatBuffer); bufLen > 0 {
+			p.chatBuffer = p.chatBuffer[:bufLen - 1]
+		}
+	case KeyRune:
+		if len(p.chatBuffer) < cap(p.chatBuffer) {
+			p.chatBuffer = append(p.chatBuffer, k.Rune)
+		}
+	}
+
+	return 0
+}
+
+// runLineCommand runs a line typed in line mode.  Lines starting with a
+// slash are chat commands, and a quote is short for say.
+func runLineCommand(p *playerEntity, line string) {
+	switch {
+	case line == "":
+		return
+	case line[0] == '/':
+		runChatCommand(p, line)
+		return
+	case line[0] == '\'':
+		doSay(p, strings.TrimSpace(line[1:]))
+		return
+	}
+
+	name, args := splitCommand(line)
+	command, ok := lineCommands[strings.ToLower(name)]
+	if !ok {
+		p.notify("Unknown command: " + name + ".  Type help for a list of commands.")
+		return
+	}
+
+	command(p, args)
+}
+
+func doSay(p *playerEntity, args string) {
+	if args == "" {
+		p.notify("Say what?")
+		return
+	}
+
+	p.owner.GetChat().Send(p, p.GetName() + ": " + args)
+}
+
+func doLineHelp(p *playerEntity, args string) {
+	p.notify("Move with n, s, e, w, ne, nw, se and sw, or north, south and so on.")
+	p.notify("look describes your surroundings and where tells you your position.")
+	p.notify("say <message>, or '<message>, talks to everyone.")
+	p.notify("Chat commands such as /who and /me work as well.")
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -9,51 +10,39 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var theGame Game
 var theDatabase Database
+var theDatabaseWriter DatabaseWriter
 
-func readLine(telnet Telnet, echo bool, n int) (string, error) {
-	buffer := make([]byte, 512)
-	sb := make([]byte, 0, n)
-
-	const (
-		Default = iota
-		GotReturn
-	)
-
-	state := Default
+func readLine(term Terminal, echo bool, n int) (string, error) {
+	sb := make([]rune, 0, n)
 
 	for {
-		m, err := telnet.Read(buffer)
+		k, err := term.ReadKey()
 		if err != nil {
 			return "", err
 		}
 
-		for i := 0; i < m; i++ {
-			switch state {
-			case Default:
-				if buffer[i] == 127 || buffer[i] == 8 {
-					if len(sb) > 0 {
-						sb = sb[:len(sb) - 1]
-						if echo {
-							// Send a backspace, a space and then another backspace.
-							telnet.Put(8, ' ', 8)
-						}
-					}
-				} else if buffer[i] == '\r' {
-					state = GotReturn
-				} else if len(sb) < n && strconv.IsPrint(rune(buffer[i])) {
-					sb = append(sb, buffer[i])
-					if echo {
-						telnet.Put(buffer[i])
-					}
+		switch k.Key {
+		case KeyBackspace:
+			if len(sb) > 0 {
+				sb = sb[:len(sb) - 1]
+				if echo {
+					// Send a backspace, a space and then another backspace.
+					term.Write([]byte{8, ' ', 8})
+				}
+			}
+		case KeyEnter:
+			return string(sb), nil
+		case KeyRune:
+			if len(sb) < n && k.Mod & (ModCtrl | ModAlt) == 0 && strconv.IsPrint(k.Rune) {
+				sb = append(sb, k.Rune)
+				if echo {
+					term.Write([]byte(string(k.Rune)))
 				}
-			case GotReturn:
-				return string(sb), nil
-				
-				state = Default
 			}
 		}
 	}
@@ -72,11 +61,18 @@ var title = []string{
 
 type stateFunc func(int, int) (stateFunc, error)
 
-// doAuthentication handles the authentication process.
-func doAuthentication(telnet Telnet) (bool, string) {
+// doAuthentication handles the authentication process for a client at
+// an address.
+func doAuthentication(term Terminal, host string) (bool, string) {
+	term.SetReadTimeout(LoginTimeout)
+
+	if term.GetLineMode() {
+		return doLineAuthentication(term, host)
+	}
+
 	writeLine := func(x, y int, s string) {
-		telnet.GoTo(uint16(x), uint16(y))
-		telnet.Write([]byte(s))
+		term.GoTo(x, y)
+		term.Write([]byte(s))
 	}
 
 	clearRect := func(x, y, w, h int) {
@@ -91,28 +87,34 @@ func doAuthentication(telnet Telnet) (bool, string) {
 	clearRect(0, 0, 80, 24)
 
 	for i := range title {
-		telnet.GoTo(12, uint16(i + 1))
-		telnet.Write([]byte(title[i]))
+		term.GoTo(11, i)
+		term.Write([]byte(title[i]))
 	}
 
-	telnet.ShowCursor(true)
+	term.ShowCursor(true)
 
 	var writeMenu stateFunc
 	var logIn stateFunc
 	var createAccount stateFunc
 
+	// Screen reader mode may be chosen before logging in, since the game
+	// screen is of no use to a player who needs it.
+	screenReader, screenReaderChosen := false, false
+	onOff := map[bool]string{false: "off", true: "on"}
+
 	writeMenu = func(x, y int) (sf stateFunc, err error) {
 		sf = writeMenu
 		err = nil
 
-		clearRect(x, y, 18, 5)
+		clearRect(x, y, 24, 6)
 
 		writeLine(x, y, "1. Log in")
 		writeLine(x, y + 1, "2. Create account")
 		writeLine(x, y + 2, "3. Disconnect")
-		writeLine(x, y + 4, "Selection: ")
+		writeLine(x, y + 3, "4. Screen reader mode: " + onOff[screenReader])
+		writeLine(x, y + 5, "Selection: ")
 
-		selection, err := readLine(telnet, true, 1)
+		selection, err := readLine(term, true, 1)
 		if err != nil {
 			sf = nil
 			return
@@ -121,12 +123,15 @@ func doAuthentication(telnet Telnet) (bool, string) {
 		switch selection {
 		case "1":
 			sf = logIn
-			clearRect(x, y, 18, 5)
+			clearRect(x, y, 24, 6)
 		case "2":
 			sf = createAccount
-			clearRect(x, y, 18, 5)
+			clearRect(x, y, 24, 6)
 		case "3":
 			sf = nil
+		case "4":
+			screenReader = !screenReader
+			screenReaderChosen = true
 		}
 
 		return
@@ -148,7 +153,7 @@ func doAuthentication(telnet Telnet) (bool, string) {
 		name, password, email := "", "", ""
 		for {
 			writeLine(x, userNameLine, "User name: ")
-			name, err = readLine(telnet, true, 16)
+			name, err = readLine(term, true, 16)
 			if err != nil {
 				return
 			}
@@ -164,7 +169,7 @@ func doAuthentication(telnet Telnet) (bool, string) {
 
 		for {
 			writeLine(x, passwordLine, "Password: ")
-			password, err = readLine(telnet, false, 64)
+			password, err = readLine(term, false, 64)
 			if err != nil {
 				return
 			}
@@ -176,7 +181,7 @@ func doAuthentication(telnet Telnet) (bool, string) {
 
 			var repeatPassword string
 			writeLine(x, repeatPasswordLine, "Repeat Password: ")
-			repeatPassword, err = readLine(telnet, false, 64)
+			repeatPassword, err = readLine(term, false, 64)
 			if err != nil {
 				return
 			}
@@ -191,7 +196,7 @@ func doAuthentication(telnet Telnet) (bool, string) {
 		}
 
 		writeLine(x, emailLine, "E-Mail for password recovery: ")
-		email, err = readLine(telnet, true, 254)
+		email, err = readLine(term, true, 254)
 
 		success, err := theDatabase.CreateUser(name, password, email)
 		clearRect(x, userNameLine, 80, 5)
@@ -211,19 +216,23 @@ func doAuthentication(telnet Telnet) (bool, string) {
 		err = nil
 
 		writeLine(x, y, "User name: ")
-		name, err = readLine(telnet, true, 16)
+		name, err = readLine(term, true, 16)
 		if err != nil {
 			return
 		}
 
 		writeLine(x, y + 1, "Password: ")
-		password, err := readLine(telnet, false, 64)
+		password, err := readLine(term, false, 64)
 		if err != nil {
 			return
 		}
 
-		authenticated = theDatabase.Authenticate(name, password)
-		if !authenticated {
+		authenticated, err = checkPassword(theDatabase, host, name, password)
+		if err != nil {
+			clearRect(x, y, 27, 2)
+			writeLine(x, y + 2, capitalize(err.Error()))
+			return
+		} else if !authenticated {
 			clearRect(x, y, 27, 2)
 			writeLine(x, y + 2, "Invalid credentials")
 		} else {
@@ -236,9 +245,9 @@ func doAuthentication(telnet Telnet) (bool, string) {
 	curState := writeMenu
 
 	for {
-		nextState, err := curState(1, 10)
+		nextState, err := curState(0, 9)
 		if err != nil {
-			log.Printf(err.Error())
+			log.Print(err)
 			return false, ""
 		}
 
@@ -248,79 +257,105 @@ func doAuthentication(telnet Telnet) (bool, string) {
 		}		
 	}
 
+	if authenticated && screenReaderChosen {
+		if err := theDatabase.SetScreenReader(name, screenReader); err != nil {
+			log.Print(err)
+		}
+	}
+
 	// Clear the screen.
-	w, h := telnet.GetScreenSize()
-	clearRect(0, 0, int(w), int(h))
+	w, h := term.GetSize()
+	clearRect(0, 0, w, h)
 
 	return authenticated, name
 }
 
-// createConnectionHandler creates a goroutine that handles a single
-// telnet connection.
-func createConnectionHandler(conn net.Conn) {
-	logFormat := fmt.Sprintf("%s: %%s", conn.RemoteAddr().String())
+// runSession puts an authenticated user into the game, or back into it
+// if their player is link-dead or playing elsewhere, and feeds it their
+// keys until the connection is lost.  Players who chose screen reader mode, whose client
+// says they use a screen reader or whose terminal is in line mode play
+// in text.
+func runSession(term Terminal, name string, logPrintf func(string, ...interface{})) {
+	caps := term.GetCapabilities()
+	logPrintf("%s logged in, %s", name, caps)
+	term.ShowCursor(false)
+	term.SetReadTimeout(gameReadTimeout())
+
+	player, resumed := theGame.JoinPlayer(term, name)
+	if player == nil {
+		logPrintf("%s is already playing, refusing login", name)
+		term.Write([]byte("You are already playing from another connection.\r\n"))
+		return
+	} else if resumed {
+		logPrintf("%s reconnected", name)
+	} else {
+		player.SetKeyBindings(LoadKeyBindings(theDatabase, name))
+		player.SetInventory(theDatabase.GetInventory(name))
+		if x, y, ok := theDatabase.GetPosition(name); ok {
+			restorePosition(player, x, y)
+		}
+	}
+	player.SetTextMode(term.GetLineMode() || caps.ScreenReader() || theDatabase.GetScreenReader(name))
 
-	logPrintf := func(format string, v ...interface{}) {
-		log.Printf(fmt.Sprintf(logFormat, format), v...)
+	for {
+		k, err := term.ReadKey()
+		if err != nil {
+			logPrintf("%s", err)
+			break
+		}
+
+		player.AddKey(k)
 	}
 
-	handlerProc := func() {
-		buffer := make([]byte, 512)
+	theGame.DisconnectPlayer(player, term)
+}
 
-		telnet := MakeTelnet(conn)
-		defer telnet.Close()
+// makeLogPrintf returns a log function that prefixes messages with the
+// remote address of a connection.
+func makeLogPrintf(addr string) func(string, ...interface{}) {
+	logFormat := fmt.Sprintf("%s: %%s", addr)
 
-		if authenticated, name := doAuthentication(telnet); authenticated {
-			telnet.ShowCursor(false)
-			player := theGame.CreatePlayer(telnet)
-			player.SetName(name)
+	return func(format string, v ...interface{}) {
+		log.Printf(fmt.Sprintf(logFormat, format), v...)
+	}
+}
 
-			for {
-				n, err := telnet.Read(buffer)
-				if err != nil {
-					logPrintf(err.Error())
-					break
-				}
+// createConnectionHandler creates a goroutine that handles a single
+// telnet connection.  Connections the gatekeeper refuses are told why and
+// closed.
+func createConnectionHandler(conn net.Conn) {
+	logPrintf := makeLogPrintf(conn.RemoteAddr().String())
+	host := remoteHost(conn.RemoteAddr().String())
 
-				text := string(buffer[:n])
-				logPrintf("Received %d bytes: %s\n", n, text)
-
-				// Process commands that are packed in a buffer.  This will
-				// mess up in certain cases when the codes are longer than
-				// 3 bytes or an incomplete character is received.
-				for i := 0; i < n; {
-					// Escape chcaracter.
-					if buffer[i] == 27 {
-						end := Mini(i + 3, n)
-
-						// Check up to 5 characters for an "end" character.  It seems to
-						// show up in the longer character codes.
-						for k := 1; k < 5 && i + k < n; k++ {
-							if buffer[i + k] == '~' {
-								end = i + k + 1
-								break
-							}
-						}
-
-					
-						player.AddCommand(MakeCommand(buffer[i:end]))
-						i = end
-					} else if buffer[i] == '\r' {
-						if i + 1 < n && buffer[i + 1] == '\n' {
-							player.AddCommand(MakeCommand(buffer[i:i+2]))
-							i += 2
-						} else {
-							player.AddCommand(MakeCommand([]byte{'\r', '\n'}))
-							i++
-						}
-					} else {
-						player.AddCommand(MakeCommand(buffer[i:i + 1]))
-						i++
-					}
-				}
+	handlerProc := func() {
+		if err := theGatekeeper.Connect(host); err != nil {
+			logPrintf("Refused: %s", err.Error())
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte(capitalize(err.Error()) + ".\r\n"))
+			conn.Close()
+			return
+		}
+		defer theGatekeeper.Disconnect(host)
+
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := handshakeTLS(tlsConn); err != nil {
+				logPrintf("TLS handshake failed: %s", err.Error())
+				conn.Close()
+				return
 			}
+		}
 
-			theGame.RemoveEntity(player)
+		terminal := MakeTerminal(MakeTelnet(conn))
+		defer terminal.Close()
+
+		waitForTerminal(terminal)
+		if isDumbTerminal(terminal) {
+			logPrintf("Terminal cannot address the cursor, using line mode")
+			terminal.SetLineMode(true)
+		}
+
+		if authenticated, name := doAuthentication(terminal, host); authenticated {
+			runSession(terminal, name, logPrintf)
 		}
 
 		logPrintf("Disconnecting\n")
@@ -336,7 +371,7 @@ func createConnectionListener(listener net.Listener) {
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
-				log.Printf(err.Error())
+				log.Print(err)
 				break
 			}
 			log.Printf("Connection from: %s\n", conn.RemoteAddr().String())
@@ -348,7 +383,50 @@ func createConnectionListener(listener net.Listener) {
 	go listenerProc()
 }
 
+// listen opens a listening socket for a frontend.  A frontend whose
+// address is unavailable is disabled rather than stopping the server.
+// Connections it accepts have TCP keepalives on.
+func listen(frontend, addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("%s disabled: %s", frontend, err.Error())
+		return nil
+	}
+
+	log.Printf("%s listening on %s", frontend, listener.Addr().String())
+	return keepAliveListener{listener.(*net.TCPListener)}
+}
+
 func main() {
+	flag.DurationVar(&TickDuration, "tick", TickDuration, "time between game updates")
+	flag.IntVar(&PlayerSpeed, "player-speed", PlayerSpeed, "energy players gain per tick")
+	flag.IntVar(&DogSpeed, "dog-speed", DogSpeed, "energy dogs gain per tick")
+	flag.IntVar(&MoveCost, "move-cost", MoveCost, "energy needed to move one tile")
+	flag.StringVar(&ServerName, "name", ServerName, "server name reported to MUD listings")
+	telnetAddr := flag.String("telnet", ":23", "address for telnet connections, empty to disable")
+	telnetTLSAddr := flag.String("telnet-tls", ":992", "address for telnet over TLS, empty to disable")
+	tlsCert := flag.String("tls-cert", "tls_cert.pem", "TLS certificate, generated if missing")
+	tlsKey := flag.String("tls-key", "tls_key.pem", "TLS private key, generated if missing")
+	sshAddr := flag.String("ssh", ":2222", "address for SSH connections, empty to disable")
+	sshHostKey := flag.String("ssh-host-key", "ssh_host_key", "SSH host key, generated if missing")
+	webAddr := flag.String("web", ":8080", "address for the web client, empty to disable")
+	flag.DurationVar(&TLSHandshakeTimeout, "tls-handshake-timeout", TLSHandshakeTimeout, "time a client has to finish the TLS handshake")
+	flag.DurationVar(&LoginTimeout, "login-timeout", LoginTimeout, "time a client may be idle while logging in, 0 for no limit")
+	flag.DurationVar(&IdleTimeout, "idle-timeout", IdleTimeout, "time a player may be idle before being disconnected, 0 for no limit")
+	flag.DurationVar(&IdleWarning, "idle-warning", IdleWarning, "how long before disconnecting idle players to warn them")
+	flag.DurationVar(&LinkDeadTimeout, "link-dead", LinkDeadTimeout, "time a disconnected player stays in the world, 0 to remove them at once")
+	flag.DurationVar(&KeepAliveInterval, "keepalive", KeepAliveInterval, "time between keepalive checks on idle connections, 0 to disable")
+	flag.Int64Var(&MaxBacklogBytes, "max-backlog-bytes", MaxBacklogBytes, "output a client may fall behind by before it is disconnected, 0 for no limit")
+	flag.IntVar(&MaxBacklogFrames, "max-backlog-frames", MaxBacklogFrames, "frames in a row a client may miss before it is disconnected, 0 for no limit")
+	flag.BoolVar(&TakeOverSessions, "takeover", TakeOverSessions, "let a second login take over a user's player, otherwise refuse it")
+	flag.IntVar(&MaxConnectionsPerIP, "max-connections-per-ip", MaxConnectionsPerIP, "connections an address may have open at once, 0 for no limit")
+	flag.DurationVar(&LoginBackoff, "login-backoff", LoginBackoff, "wait after a wrong password, doubling with each one")
+	flag.DurationVar(&MaxLoginBackoff, "max-login-backoff", MaxLoginBackoff, "longest wait after wrong passwords")
+	flag.IntVar(&MaxLoginFailures, "max-login-failures", MaxLoginFailures, "wrong passwords before an address is locked out, 0 for no limit")
+	flag.DurationVar(&LockoutDuration, "lockout", LockoutDuration, "time an address is locked out for")
+	banFile := flag.String("ban-list", "bans.txt", "file of banned addresses and CIDR ranges")
+	flag.Parse()
+
 	c := make(chan os.Signal, 1)
 	wait := make(chan int, 1)
 	signal.Notify(c, os.Interrupt)
@@ -361,36 +439,61 @@ func main() {
 	}()
 
 	theDatabase = MakeDatabase()
+	theDatabaseWriter = MakeDatabaseWriter()
 	theGame = MakeGame()
+	theGatekeeper = MakeGatekeeper(*banFile)
 
 	theGame.Start()
 
-	listener, err := net.Listen("tcp", ":23")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer listener.Close()
+	listening := false
 
-	createConnectionListener(listener)
+	if *telnetAddr != "" {
+		if listener := listen("Telnet", *telnetAddr); listener != nil {
+			defer listener.Close()
+			addServerPort("PORT", listener)
+			createConnectionListener(listener)
+			listening = true
+		}
+	}
 
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			log.Printf(err.Error())
-			break
+	if *telnetTLSAddr != "" {
+		if config, err := MakeTLSConfig(*tlsCert, *tlsKey); err != nil {
+			log.Printf("Telnet over TLS disabled: %s", err.Error())
+		} else if listener := listen("Telnet over TLS", *telnetTLSAddr); listener != nil {
+			defer listener.Close()
+			addServerPort("SSL", listener)
+			createConnectionListener(tls.NewListener(listener, config))
+			listening = true
 		}
+	}
 
-		command := strings.TrimSpace(line)
+	if *sshAddr != "" {
+		if config, err := MakeSSHConfig(theDatabase, *sshHostKey); err != nil {
+			log.Printf("SSH disabled: %s", err.Error())
+		} else if listener := listen("SSH", *sshAddr); listener != nil {
+			defer listener.Close()
+			createSSHListener(listener, config)
+			listening = true
+		}
+	}
 
-		if command == "quit" {
-			break
-		} else {
-			fmt.Printf("Unknown command: %s\n", command)
+	if *webAddr != "" {
+		if listener := listen("Web client", *webAddr); listener != nil {
+			defer listener.Close()
+			createWebListener(listener)
+			listening = true
 		}
 	}
 
+	if !listening {
+		log.Printf("Not listening for any connections")
+	}
+
+	runConsole(os.Stdin, os.Stdout)
+	savePositions()
+
 	theGame.Stop()
+	theDatabaseWriter.Close()
 	theDatabase.Close()
 	wait <- 0
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// MCCP2 compresses everything the server sends once the client has
+// agreed to it.  The server announces the start of the zlib stream with
+// an empty subnegotiation, and ends it by finishing the stream.
+
+// Counters for the compression of a connection.
+type CompressionStats struct {
+	Enabled		bool
+	Raw		int64
+	Compressed	int64
+}
+
+func (s CompressionStats) String() string {
+	if s.Raw == 0 {
+		return "not compressed"
+	}
+
+	return fmt.Sprintf("%d bytes compressed to %d (%.1f%%)",
+		s.Raw, s.Compressed, 100 * float64(s.Compressed) / float64(s.Raw))
+}
+
+// A countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w	io.Writer
+	n	int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// startCompression announces the zlib stream and compresses all output
+// from then on.
+func (tc *TelnetData) startCompression() {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+
+	if tc.compressor != nil {
+		return
+	}
+
+	tc.conn.Write([]byte{TelnetIac, TelnetSb, TelnetMccp2, TelnetIac, TelnetSe})
+
+	tc.wire = &countingWriter{w: tc.conn}
+	tc.compressor = zlib.NewWriter(tc.wire)
+}
+
+// stopCompression finishes the zlib stream; output after it is sent as
+// is.
+func (tc *TelnetData) stopCompression() {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+
+	tc.endCompression()
+}
+
+// endCompression finishes the zlib stream.  The caller must hold
+// writeLock.
+func (tc *TelnetData) endCompression() {
+	if tc.compressor == nil {
+		return
+	}
+
+	tc.compressor.Close()
+	tc.compressor = nil
+	tc.compressedBytes += tc.wire.n
+	tc.wire = nil
+}
+
+// GetCompressionStats returns how well the output has compressed so
+// far.  It may be called from any goroutine.
+func (tc *TelnetData) GetCompressionStats() CompressionStats {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+
+	s := CompressionStats{Enabled: tc.compressor != nil,
+		Raw: tc.rawBytes,
+		Compressed: tc.compressedBytes}
+	if tc.wire != nil {
+		s.Compressed += tc.wire.n
+	}
+
+	return s
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MSSP lets MUD listing sites and crawlers ask a server about itself.
+// When a client agrees to the option, the server sends its variables in
+// a single subnegotiation and the crawler usually disconnects.
+
+const (
+	MsspVar byte	= 1
+	MsspVal		= 2
+)
+
+// The name the server reports itself under.
+var ServerName = "mmgorogue"
+
+var serverStartTime = time.Now()
+
+// The ports clients can connect to, by the MSSP variable they are
+// reported in.  Listeners are added while connections are being served.
+var serverPorts = struct {
+	lock	sync.Mutex
+	ports	map[string][]string
+}{ports: make(map[string][]string)}
+
+// addServerPort records a listener so that MSSP can report it.  kind is
+// "PORT" for plain telnet or "SSL" for telnet over TLS.
+func addServerPort(kind string, listener net.Listener) {
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return
+	}
+
+	serverPorts.lock.Lock()
+	defer serverPorts.lock.Unlock()
+
+	serverPorts.ports[kind] = append(serverPorts.ports[kind], port)
+}
+
+// countPlayers returns how many players are in the game.  It is called
+// from telnet read goroutines, so it must not wait on the game, which
+// may be busy or stopped.
+func countPlayers() int {
+	if theGame == nil {
+		return 0
+	}
+
+	return theGame.CountPlayers()
+}
+
+// msspVariables returns the variables to report, in order.  A variable
+// may have several values.
+func msspVariables() [][]string {
+	vars := [][]string{
+		{"NAME", ServerName},
+		{"PLAYERS", strconv.Itoa(countPlayers())},
+		{"UPTIME", strconv.FormatInt(serverStartTime.Unix(), 10)},
+		{"CODEBASE", "mmgorogue"},
+		{"FAMILY", "Custom"},
+		{"LANGUAGE", "English"},
+		{"ANSI", "1"},
+		{"XTERM 256 COLORS", "1"},
+		{"XTERM TRUE COLORS", "1"},
+		{"GMCP", "1"},
+		{"MCCP", "1"},
+		{"MSSP", "1"},
+	}
+
+	serverPorts.lock.Lock()
+	defer serverPorts.lock.Unlock()
+
+	for _, kind := range []string{"PORT", "SSL"} {
+		if ports := serverPorts.ports[kind]; len(ports) > 0 {
+			vars = append(vars, append([]string{kind}, ports...))
+		}
+	}
+
+	return vars
+}
+
+// sendMssp sends the server's variables.
+func (tc *TelnetData) sendMssp() {
+	b := []byte{TelnetIac, TelnetSb, TelnetMssp}
+	for _, v := range msspVariables() {
+		b = append(b, MsspVar)
+		b = append(b, v[0]...)
+		for _, value := range v[1:] {
+			b = append(b, MsspVal)
+			b = append(b, value...)
+		}
+	}
+	b = append(b, TelnetIac, TelnetSe)
+
+	tc.Write(b)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMsspStoppedGame asks for MSSP once the game has stopped.  The
+// players are still counted, without waiting on the game.
+func TestMsspStoppedGame(t *testing.T) {
+	database, game := theDatabase, theGame
+	t.Cleanup(func() { theDatabase, theGame = database, game })
+	theDatabase = testDatabase{}
+
+	g := MakeGame()
+	g.Start()
+	for _, name := range []string{"alice", "bob"} {
+		g.JoinPlayer(MakeMemoryTerminal(80, 24), name)
+	}
+	g.Stop()
+	theGame = g
+
+	replies := make(chan []byte)
+	go func() {
+		replies <- msspReply()
+	}()
+
+	select {
+	case reply := <-replies:
+		want := []byte{MsspVar, 'P', 'L', 'A', 'Y', 'E', 'R', 'S', MsspVal, '2'}
+		if !bytes.Contains(reply, want) {
+			t.Errorf("MSSP reply %q does not report 2 players", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MSSP waited on the stopped game")
+	}
+}
+
+// msspReply asks a server for MSSP and returns what it sends back.
+func msspReply() []byte {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	replies := make(chan []byte)
+	go func() {
+		var reply []byte
+		b := make([]byte, 4096)
+		for !bytes.Contains(reply, []byte{TelnetIac, TelnetSb, TelnetMssp}) ||
+			!bytes.HasSuffix(reply, []byte{TelnetIac, TelnetSe}) {
+			n, err := client.Read(b)
+			reply = append(reply, b[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		replies <- reply
+	}()
+
+	tc := MakeTelnet(server)
+	defer tc.Close()
+	go func() {
+		b := make([]byte, 64)
+		for {
+			if _, err := tc.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	client.Write([]byte{TelnetIac, TelnetDo, TelnetMssp})
+	return <-replies
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// The most frames that may wait to be written to a client.  When a client
+// falls this far behind, new frames are not rendered at all; since the
+// screen keeps diffing against the last frame that was handed over, the
+// next one sent covers everything that changed in the meantime.
+const maxPendingFrames = 4
+
+// How far a client may fall behind before it is disconnected: the bytes
+// queued for it, and the frames in a row that were held back because it
+// had not taken the last ones.  They can be changed from the command line.
+var (
+	MaxBacklogBytes		int64 = 256 * 1024
+	MaxBacklogFrames	= 300
+)
+
+// A frame waiting to be drawn.  In text mode it carries text to write
+// instead of cells.
+type pendingFrame struct {
+	deltas		[]ScreenDelta
+	clear		bool
+	packages	[]gmcpPackage
+	text		[]byte
+	textMode	bool
+	disconnect	bool
+}
+
+// size returns about how many bytes a frame takes to write.
+func (f *pendingFrame) size() int64 {
+	n := len(f.text)
+	for _, d := range f.deltas {
+		n += len(d.data)
+	}
+	for _, pkg := range f.packages {
+		n += len(pkg.name) + len(pkg.data)
+	}
+
+	return int64(n)
+}
+
+// A sessionWriter draws frames to a terminal on its own goroutine so that
+// a slow connection only holds up itself and not the game loop.
+type sessionWriter struct {
+	terminal	Terminal
+	frames		chan pendingFrame
+	clear		bool
+	pending		int64
+	behind		int
+	disconnecting	bool
+	closed		bool
+}
+
+func makeSessionWriter(t Terminal) *sessionWriter {
+	w := &sessionWriter{terminal: t,
+		frames: make(chan pendingFrame, maxPendingFrames)}
+	go w.run()
+	return w
+}
+
+// run writes frames as they come.  The cursor is shown in text mode,
+// where it marks the line being typed, and hidden otherwise.
+func (w *sessionWriter) run() {
+	cursor := false
+
+	for frame := range w.frames {
+		for _, pkg := range frame.packages {
+			w.terminal.SendPackage(pkg.name, pkg.data)
+		}
+
+		if len(frame.deltas) > 0 || frame.clear {
+			w.terminal.Draw(frame.deltas, frame.clear)
+		}
+
+		if frame.textMode != cursor {
+			cursor = frame.textMode
+			w.terminal.ShowCursor(cursor)
+		}
+
+		if len(frame.text) > 0 {
+			w.terminal.Write(frame.text)
+		}
+
+		atomic.AddInt64(&w.pending, -frame.size())
+
+		if frame.disconnect {
+			w.terminal.Close()
+		}
+	}
+}
+
+// GetStats returns the output counters of the terminal.
+func (w *sessionWriter) GetStats() OutputStats {
+	return w.terminal.GetStats()
+}
+
+// Ready reports whether the writer can take another frame.  A client
+// whose backlog has grown past MaxBacklogBytes or MaxBacklogFrames is
+// disconnected, and the writer is never ready again.
+func (w *sessionWriter) Ready() bool {
+	if w.closed {
+		return false
+	} else if pending := atomic.LoadInt64(&w.pending); MaxBacklogBytes > 0 && pending > MaxBacklogBytes {
+		log.Printf("Disconnecting client with %d bytes of output backlog", pending)
+		w.closeNow()
+		return false
+	}
+
+	if len(w.frames) < cap(w.frames) {
+		w.behind = 0
+		return true
+	}
+
+	if w.behind++; MaxBacklogFrames > 0 && w.behind > MaxBacklogFrames {
+		log.Printf("Disconnecting client %d frames behind", w.behind)
+		w.closeNow()
+	}
+
+	return false
+}
+
+// closeNow closes the terminal without waiting for the queued frames.
+func (w *sessionWriter) closeNow() {
+	if w.closed {
+		return
+	}
+
+	w.closed = true
+	w.disconnecting = true
+	w.terminal.Close()
+}
+
+// Send queues a frame and any GMCP packages for writing.  Frames with
+// nothing in them are not sent.  Callers should check Ready first; a
+// frame sent to a full writer is dropped.
+func (w *sessionWriter) Send(frame []ScreenDelta, packages []gmcpPackage) {
+	w.queue(pendingFrame{deltas: frame, packages: packages})
+}
+
+// SendText queues text for a player in text mode, the counterpart of
+// Send.  The text must not be changed afterwards.
+func (w *sessionWriter) SendText(text []byte, packages []gmcpPackage) {
+	w.queue(pendingFrame{text: text, packages: packages, textMode: true})
+}
+
+func (w *sessionWriter) queue(frame pendingFrame) {
+	if len(frame.deltas) == 0 && len(frame.text) == 0 && len(frame.packages) == 0 && !w.clear {
+		return
+	}
+
+	frame.clear = w.clear
+	atomic.AddInt64(&w.pending, frame.size())
+	select {
+	case w.frames <- frame:
+		w.clear = false
+	default:
+		atomic.AddInt64(&w.pending, -frame.size())
+	}
+}
+
+// Redraw clears the terminal before the next frame.  The caller must
+// also invalidate the screen so that the frame covers all of it.
+func (w *sessionWriter) Redraw() {
+	w.clear = true
+}
+
+// Disconnect writes a message, if any, and closes the terminal once the
+// frames queued so far are written, or closes it at once if the client is
+// too far behind to wait for.
+func (w *sessionWriter) Disconnect(message string) {
+	if w.disconnecting {
+		return
+	}
+	w.disconnecting = true
+
+	frame := pendingFrame{text: []byte(message), disconnect: true}
+	atomic.AddInt64(&w.pending, frame.size())
+	select {
+	case w.frames <- frame:
+	default:
+		atomic.AddInt64(&w.pending, -frame.size())
+		w.closeNow()
+	}
+}
+
+// Close stops the writer once the queued frames are written.
+func (w *sessionWriter) Close() {
+	close(w.frames)
+}
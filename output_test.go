@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stalledTransport is a client that stops taking output once its
+// window, like a socket's send buffer, is full.  Reads and writes that
+// cannot go on block until it is closed.
+type stalledTransport struct {
+	window		int
+	closed		chan bool
+	closeOnce	sync.Once
+}
+
+var errStalledClosed = errors.New("stalled transport closed")
+
+func (s *stalledTransport) Read(b []byte) (int, error) {
+	<-s.closed
+	return 0, errStalledClosed
+}
+
+func (s *stalledTransport) Write(b []byte) (int, error) {
+	if len(b) <= s.window {
+		s.window -= len(b)
+		return len(b), nil
+	}
+
+	<-s.closed
+	return 0, errStalledClosed
+}
+
+func (s *stalledTransport) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (*stalledTransport) GetScreenSize() (int, int) {
+	return 80, 24
+}
+
+func (*stalledTransport) GetCapabilities() Capabilities {
+	return Capabilities{TerminalType: "XTERM"}
+}
+
+// TestBacklogDisconnect lets a client that takes no output fall behind
+// until it is disconnected, and its handler close the terminal again.
+func TestBacklogDisconnect(t *testing.T) {
+	maxBytes := MaxBacklogBytes
+	t.Cleanup(func() { MaxBacklogBytes = maxBytes })
+	MaxBacklogBytes = 1024
+	g := startTestGame(t)
+
+	term := MakeTerminal(&stalledTransport{window: 64, closed: make(chan bool)})
+	done := make(chan bool)
+	go func() {
+		runSession(term, "gina", discardLog)
+		term.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client that fell behind was never disconnected")
+	}
+
+	g.Synchronize(func() {
+		if p := g.FindPlayer("gina"); p != nil && !p.IsLinkDead() {
+			t.Error("disconnected player is still attached")
+		}
+	})
+}
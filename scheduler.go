@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+)
+
+// Entities gain energy every tick according to their speed and spend it
+// on actions.  An entity may start an action once it has at least
+// ActionThreshold energy, so an entity with speed 50 can make a move
+// costing 100 every other tick.  Energy does not accumulate past the
+// threshold, which stops idle entities from saving up a burst of moves.
+const ActionThreshold = 100
+
+// Game pacing.  These are variables so that they can be set from the
+// command line.
+var (
+	TickDuration	= 100 * time.Millisecond
+	PlayerSpeed	= 50
+	DogSpeed	= 10
+	MoveCost	= 100
+)
+
+// The most keys a player may have waiting to be processed.  Anything
+// typed beyond this is dropped.
+const maxQueuedKeys = 16
+
+// In line mode keys arrive a whole line at a time, so a few lines may
+// wait.
+const maxQueuedLineKeys = 512
+
+// A scheduler keeps track of the energy of every entity.
+type scheduler struct {
+	energy	map[Entity]int
+}
+
+func makeScheduler() *scheduler {
+	return &scheduler{make(map[Entity]int)}
+}
+
+// Add starts scheduling an entity.  New entities may act on their first
+// tick.
+func (s *scheduler) Add(e Entity) {
+	s.energy[e] = ActionThreshold
+}
+
+func (s *scheduler) Remove(e Entity) {
+	delete(s.energy, e)
+}
+
+// GetEnergy returns the energy an entity currently has.
+func (s *scheduler) GetEnergy(e Entity) int {
+	return s.energy[e]
+}
+
+// Tick gives every entity its energy for this tick and lets it act.
+func (s *scheduler) Tick() {
+	for e, energy := range s.energy {
+		energy = Mini(energy + e.GetSpeed(), ActionThreshold)
+		s.energy[e] = energy - e.Act(energy)
+	}
+}
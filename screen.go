@@ -4,30 +4,28 @@ import (
 	"fmt"
 )
 
-// A difference in the screen appearance.  Can be applied to a Telnet
-// interface to be sent over the network.
+// A difference in the screen appearance.  A FrameEncoder turns a list of
+// them into bytes to be sent over the network.
 type ScreenDelta struct {
-	x, y int
-	data []byte
-}
-
-func (d ScreenDelta) Apply(t Telnet) {
-	t.GoTo(uint16(d.x + 1), uint16(d.y + 1))
-	t.Write(d.data)
+	x, y	int
+	data	[]rune
+	style	Style
 }
 
 func (d ScreenDelta) String() string {
 	return fmt.Sprintf("x: %d y: %d data: %s", d.x, d.y, string(d.data))
 }
 
-// A sub region of the screen.
+// A sub region of the screen.  Each cell holds one character; Write
+// takes text in UTF-8.
 type Region interface {
 	GoTo(x, y int)
-	Put(b ...byte)
+	Put(r ...rune)
 	Write(b []byte)
 	GetSize() (int, int)
 	MakeRegion(x, y, w, h int) Region
-	Clear(x, y, w, h int, b byte)
+	Clear(x, y, w, h int, r rune)
+	SetStyle(s Style)
 }
 
 type region struct {
@@ -43,16 +41,27 @@ func (r *region) GoTo(x, y int) {
 	r.parent.GoTo(r.x + r.cx, r.y + r.cy)
 }
 
-func (r *region) Put(b ...byte) {
-	r.Write(b)
-}
+func (r *region) Put(c ...rune) {
+	if r.cy < 0 || r.cy >= r.height {
+		r.cx += len(c)
+		return
+	}
 
-func (r *region) Write(b []byte) {
-	remainingWidth := Mini(len(b), r.width - r.cx)
+	if r.cx < 0 {
+		skip := Mini(-r.cx, len(c))
+		c = c[skip:]
+		r.GoTo(r.cx + skip, r.cy)
+	}
+
+	remainingWidth := Mini(len(c), r.width - r.cx)
 	if remainingWidth > 0 {
-		r.parent.Write(b[:remainingWidth])
-		r.cx += remainingWidth
+		r.parent.Put(c[:remainingWidth]...)
 	}
+	r.cx += len(c)
+}
+
+func (r *region) Write(b []byte) {
+	r.Put([]rune(string(b))...)
 }
 
 func (r region) GetSize() (int, int) {
@@ -63,8 +72,18 @@ func (r *region) MakeRegion(x, y, w, h int) Region {
 	return &region{r, x, y, w, h, 0, 0}
 }
 
-func (r *region) Clear(x, y, w, h int, b byte) {
-	r.parent.Clear(r.x + x, r.y + y, w, h, b)
+// SetStyle sets the colors of what is written next.  The style is shared
+// with the parent.
+func (r *region) SetStyle(s Style) {
+	r.parent.SetStyle(s)
+}
+
+func (r *region) Clear(x, y, w, h int, b rune) {
+	x0, y0 := Maxi(x, 0), Maxi(y, 0)
+	x1, y1 := Mini(x + w, r.width), Mini(y + h, r.height)
+	if x0 < x1 && y0 < y1 {
+		r.parent.Clear(r.x + x0, r.y + y0, x1 - x0, y1 - y0, b)
+	}
 }
 
 // An abstract screen that is viewed by the player.
@@ -72,83 +91,114 @@ type Screen interface {
 	Region
 	Flip()
 	GetDelta() []ScreenDelta
+	Invalidate()
 }
 
 type screen struct {
 	width, height	int
 	cx, cy		int
 	currentBuffer	int
-	buffer		[][]byte
-	delta		[]byte
+	buffer		[][]rune
+	styles		[][]Style
+	style		Style
+	invalid		bool
 }
 
-// MakeScreen creates a new screen of a specified width and height.
+// MakeScreen creates a new screen of a specified width and height.  The
+// screen starts out blank and invalid, so the first delta redraws it
+// entirely.
 func MakeScreen(width, height int) Screen {
 	s := &screen{
 		width: width,
 		height: height,
 		cx: 0,
 		cy: 0,
-		currentBuffer: 0}
+		currentBuffer: 0,
+		style: DefaultStyle,
+		invalid: true}
 
-	s.buffer = make([][]byte, 2)
+	s.buffer = make([][]rune, 2)
+	s.styles = make([][]Style, 2)
 	for i := range s.buffer {
-		s.buffer[i] = make([]byte, width * height)
+		s.buffer[i] = make([]rune, width * height)
+		s.styles[i] = make([]Style, width * height)
+		for j := range s.buffer[i] {
+			s.buffer[i][j] = ' '
+			s.styles[i][j] = DefaultStyle
+		}
 	}
 
-	s.delta = make([]byte, width * height)
 	return s
 }
 
-// Clear clears a portion of the screen.
-func (s *screen) Clear(x, y, w, h int, b byte) {
+// SetStyle sets the colors of what is written next.
+func (s *screen) SetStyle(style Style) {
+	s.style = style
+}
+
+// Clear clears a portion of the screen with the current style.
+func (s *screen) Clear(x, y, w, h int, b rune) {
 	cur := s.getCurrentBuffer()
+	styles := s.styles[s.currentBuffer]
 
-	for r := y; r < y + h; r++ {
-		for c := x; c < x + w; c++ {
+	for r := Maxi(y, 0); r < Mini(y + h, s.height); r++ {
+		for c := Maxi(x, 0); c < Mini(x + w, s.width); c++ {
 			cur[r * s.width + c] = b
+			styles[r * s.width + c] = s.style
 		}
 	}
 }
 
-// Flip switches to a new screen buffer.
+// Flip marks the current buffer as shown and starts a new one with the
+// same contents.
 func (s *screen) Flip() {
 	s.currentBuffer = 1 - s.currentBuffer
+	copy(s.getCurrentBuffer(), s.buffer[1 - s.currentBuffer])
+	copy(s.styles[s.currentBuffer], s.styles[1 - s.currentBuffer])
+	s.invalid = false
+}
+
+// Invalidate makes the next delta cover the whole screen, for when the
+// terminal no longer shows what was last sent.
+func (s *screen) Invalidate() {
+	s.invalid = true
 }
 
 // GetDelta returns the difference between the current and last screen.
+// Each delta is a run of changed cells of the same style.  The deltas
+// hold copies of the screen contents, so they stay valid after the
+// screen is drawn to again.
 func (s screen) GetDelta() []ScreenDelta {
 	cur := s.getCurrentBuffer()
 	last := s.buffer[1 - s.currentBuffer]
+	styles := s.styles[s.currentBuffer]
+	lastStyles := s.styles[1 - s.currentBuffer]
 
-	for i := range s.delta {
-		s.delta[i] = cur[i] - last[i]
+	changed := func(i int) bool {
+		return s.invalid || cur[i] != last[i] || styles[i] != lastStyles[i]
 	}
 
 	delta := make([]ScreenDelta, 0, 30)
 
 	for r := 0; r < s.height; r++ {
-		i, j := 0, 0
-		for i < s.width {
-			for ; j < s.width; j++ {
-				if s.delta[r * s.width + j] != 0 {
-					break
-				}
+		row := r * s.width
+		j := 0
+		for j < s.width {
+			for ; j < s.width && !changed(row + j); j++ {
 			}
 
-			i = j
+			i := j
 
-			for ; j < s.width; j++ {
-				if s.delta[r * s.width + j] == 0 {
-					break
-				}
+			for ; j < s.width && changed(row + j) && styles[row + j] == styles[row + i]; j++ {
 			}
 
 			if i == j {
 				break
 			}
 
-			delta = append(delta, ScreenDelta{i, r, cur[r * s.width + i:r * s.width + j]})
+			data := make([]rune, j - i)
+			copy(data, cur[row + i:row + j])
+			delta = append(delta, ScreenDelta{i, r, data, styles[row + i]})
 		}
 	}
 
@@ -162,7 +212,7 @@ func (s *screen) GoTo(x, y int) {
 }
 
 // getCurrentBuffer returns the current active buffer.
-func (s screen) getCurrentBuffer() []byte {
+func (s screen) getCurrentBuffer() []rune {
 	return s.buffer[s.currentBuffer]
 }
 
@@ -171,16 +221,26 @@ func (s screen) getCursorIndex() int {
 	return s.cy * s.width + s.cx
 }
 
-// Put writes a list of bytes to the screen.
-func (s *screen) Put(b ...byte) {
-	s.Write(b)
+// Write writes UTF-8 text to the screen.
+func (s *screen) Write(b []byte) {
+	s.Put([]rune(string(b))...)
 }
 
-// Write writes an array of bytes to the screen.
-func (s *screen) Write(b []byte) {
-	n := Mini(len(b), s.width - s.cx)
-	for i := 0; i < n; i++ {
-		s.getCurrentBuffer()[s.getCursorIndex()] = b[i]
+// Put writes characters to the screen.  Anything that falls outside of
+// the screen is dropped.
+func (s *screen) Put(b ...rune) {
+	if s.cy < 0 || s.cy >= s.height {
+		s.cx += len(b)
+		return
+	}
+
+	cur := s.getCurrentBuffer()
+	styles := s.styles[s.currentBuffer]
+	for i := range b {
+		if s.cx >= 0 && s.cx < s.width {
+			cur[s.getCursorIndex()] = b[i]
+			styles[s.getCursorIndex()] = s.style
+		}
 		s.cx++
 	}
 }
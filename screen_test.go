@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var testStyle = Style{RGB(255, 0, 0), ColorDefault}
+
+// describeDeltas turns deltas into strings that are easy to compare.
+func describeDeltas(deltas []ScreenDelta) []string {
+	var s []string
+	for _, d := range deltas {
+		text := fmt.Sprintf("%d,%d %q", d.x, d.y, string(d.data))
+		if d.style != DefaultStyle {
+			text += " styled"
+		}
+		s = append(s, text)
+	}
+
+	return s
+}
+
+// testScreen returns a 10x3 screen showing "hello" in its top left
+// corner, with nothing left to send.
+func testScreen() Screen {
+	s := MakeScreen(10, 3)
+	s.GoTo(0, 0)
+	s.Write([]byte("hello"))
+	s.Flip()
+
+	return s
+}
+
+func TestScreenDelta(t *testing.T) {
+	tests := []struct {
+		name	string
+		draw	func(s Screen)
+		want	[]string
+	}{
+		{"nothing drawn", func(s Screen) {}, nil},
+		{"same text again", func(s Screen) {
+			s.GoTo(0, 0)
+			s.Write([]byte("hello"))
+		}, nil},
+		{"changed text", func(s Screen) {
+			s.GoTo(1, 0)
+			s.Write([]byte("ipp"))
+		}, []string{`1,0 "ipp"`}},
+		{"unchanged cells split a run", func(s Screen) {
+			s.GoTo(0, 0)
+			s.Write([]byte("jelly"))
+		}, []string{`0,0 "j"`, `4,0 "y"`}},
+		{"style only", func(s Screen) {
+			s.SetStyle(testStyle)
+			s.GoTo(1, 0)
+			s.Write([]byte("ell"))
+		}, []string{`1,0 "ell" styled`}},
+		{"style splits a run", func(s Screen) {
+			s.GoTo(5, 1)
+			s.Write([]byte("ab"))
+			s.SetStyle(testStyle)
+			s.Write([]byte("cd"))
+		}, []string{`5,1 "ab"`, `7,1 "cd" styled`}},
+		{"up to the right margin", func(s Screen) {
+			s.GoTo(6, 1)
+			s.Write([]byte("wxyz"))
+		}, []string{`6,1 "wxyz"`}},
+		{"clipped at the right margin", func(s Screen) {
+			s.GoTo(8, 2)
+			s.Write([]byte("abcd"))
+		}, []string{`8,2 "ab"`}},
+		{"clipped at the left margin", func(s Screen) {
+			s.GoTo(-2, 2)
+			s.Write([]byte("abcd"))
+		}, []string{`0,2 "cd"`}},
+		{"above and below the screen", func(s Screen) {
+			s.GoTo(0, -1)
+			s.Write([]byte("abc"))
+			s.GoTo(0, 3)
+			s.Write([]byte("abc"))
+		}, nil},
+		{"multibyte characters", func(s Screen) {
+			s.GoTo(0, 1)
+			s.Write([]byte("≈·≈"))
+		}, []string{`0,1 "≈·≈"`}},
+		{"wider than a region", func(s Screen) {
+			r := s.MakeRegion(2, 1, 4, 1)
+			r.GoTo(-1, 0)
+			r.Write([]byte("xabcdef"))
+		}, []string{`2,1 "abcd"`}},
+		{"below a region", func(s Screen) {
+			r := s.MakeRegion(2, 1, 4, 1)
+			r.GoTo(0, 1)
+			r.Write([]byte("abcd"))
+		}, nil},
+		{"put after the end of a region", func(s Screen) {
+			r := s.MakeRegion(2, 1, 4, 1)
+			r.GoTo(3, 0)
+			r.Put('a', 'b')
+			r.Put('c')
+		}, []string{`5,1 "a"`}},
+		{"nested regions", func(s Screen) {
+			r := s.MakeRegion(1, 1, 8, 2).MakeRegion(2, 1, 3, 5)
+			r.GoTo(0, 0)
+			r.Write([]byte("abcdef"))
+			r.GoTo(0, 1)
+			r.Write([]byte("abcdef"))
+		}, []string{`3,2 "abc"`}},
+		{"clear in a region", func(s Screen) {
+			r := s.MakeRegion(1, 1, 3, 1)
+			r.Clear(-1, 0, 10, 5, '.')
+		}, []string{`1,1 "..."`}},
+		{"style of a clear", func(s Screen) {
+			s.SetStyle(testStyle)
+			s.Clear(8, 2, 5, 1, ' ')
+		}, []string{`8,2 "  " styled`}},
+		{"invalidated", func(s Screen) {
+			s.Invalidate()
+		}, []string{`0,0 "hello     "`, `0,1 "          "`, `0,2 "          "`}},
+	}
+
+	for _, test := range tests {
+		s := testScreen()
+		test.draw(s)
+
+		if got := describeDeltas(s.GetDelta()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+
+		s.Flip()
+		if got := describeDeltas(s.GetDelta()); got != nil {
+			t.Errorf("%s: %q left after Flip", test.name, got)
+		}
+	}
+}
+
+// TestScreenResize draws the same thing on a new screen of another size,
+// as players do when their terminal is resized.  Everything is sent
+// again, since the terminal shows nothing that can be relied on.
+func TestScreenResize(t *testing.T) {
+	s := testScreen()
+	s.GoTo(0, 2)
+	s.Write([]byte("world"))
+	s.Flip()
+
+	s = MakeScreen(12, 4)
+	s.Invalidate()
+	s.GoTo(0, 0)
+	s.Write([]byte("hello"))
+	s.GoTo(0, 2)
+	s.Write([]byte("world"))
+
+	want := []string{`0,0 "hello       "`, `0,1 "            "`,
+		`0,2 "world       "`, `0,3 "            "`}
+	if got := describeDeltas(s.GetDelta()); !reflect.DeepEqual(got, want) {
+		t.Errorf("after resizing: got %q, want %q", got, want)
+	}
+
+	s.Flip()
+	s.GoTo(11, 3)
+	s.Put('!')
+	if got, want := describeDeltas(s.GetDelta()), []string{`11,3 "!"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after the redraw: got %q, want %q", got, want)
+	}
+}
+
+// TestScreenDeltaCopies checks that deltas do not change when the screen
+// is drawn to again.
+func TestScreenDeltaCopies(t *testing.T) {
+	s := testScreen()
+	s.GoTo(0, 1)
+	s.Write([]byte("abc"))
+	delta := s.GetDelta()
+
+	s.Flip()
+	s.GoTo(0, 1)
+	s.Write([]byte("xyz"))
+
+	if got := string(delta[0].data); got != "abc" {
+		t.Errorf("delta changed to %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on how long connections and players may sit doing nothing.
+// They can be changed from the command line; zero turns a limit off.
+var (
+	// How long a client may go without typing while logging in.
+	LoginTimeout		= 2 * time.Minute
+
+	// How long a player may go without typing anything, and how long
+	// before being disconnected they are warned.
+	IdleTimeout		= 30 * time.Minute
+	IdleWarning		= 5 * time.Minute
+
+	// How long a player whose connection dropped stays in the world,
+	// waiting for them to log in again.
+	LinkDeadTimeout		= 2 * time.Minute
+
+	// How often idle connections are checked for a live client.
+	KeepAliveInterval	= time.Minute
+
+	// Whether a user who logs in while already playing takes their player
+	// over from the other connection.  If not, the new login is refused.
+	TakeOverSessions	= true
+)
+
+// gameReadTimeout returns how long a player's connection may go without
+// input.  It is a little longer than the idle timeout, so that it only
+// matters for clients the game failed to disconnect.
+func gameReadTimeout() time.Duration {
+	if IdleTimeout <= 0 {
+		return 0
+	}
+
+	return IdleTimeout + time.Minute
+}
+
+// keepAliveListener turns on TCP keepalives for the connections it
+// accepts, so that clients that vanish are noticed even when idle.
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	if KeepAliveInterval > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(KeepAliveInterval)
+	}
+
+	return conn, nil
+}
+
+// checkIdle warns a player who has not typed anything for a while and
+// kicks them once IdleTimeout has passed.
+func (p *playerEntity) checkIdle() {
+	if IdleTimeout <= 0 {
+		return
+	}
+
+	idle := p.GetIdleTime()
+	switch {
+	case idle >= IdleTimeout:
+		p.Kick("You have been disconnected for being idle.")
+	case idle >= IdleTimeout - IdleWarning:
+		if !p.idleWarned {
+			p.notify(fmt.Sprintf("You have been idle for %s and will be disconnected in %s.",
+				formatIdleTime(idle), formatIdleTime(IdleTimeout - idle)))
+			p.idleWarned = true
+		}
+	default:
+		p.idleWarned = false
+	}
+}
+
+// Kick disconnects the player once they have been shown why.  Kicked
+// players leave the world instead of waiting to reconnect, and link-dead
+// ones leave at once.  It may only be used on the game goroutine.
+func (p *playerEntity) Kick(reason string) {
+	if p.removed {
+		return
+	} else if p.linkDead {
+		p.owner.removeEntity(p)
+		return
+	} else if p.kicked {
+		return
+	}
+
+	p.kicked = true
+	p.notify(reason)
+}
+
+// Detach drops the player's connection and reports whether they stay in
+// the world, link-dead, until they log in again or LinkDeadTimeout
+// passes.
+func (p *playerEntity) Detach() bool {
+	if p.kicked || LinkDeadTimeout <= 0 {
+		return false
+	}
+
+	p.closeOutput()
+	p.linkDead = true
+	p.linkDeadSince = time.Now()
+	p.chatting = false
+	p.chatBuffer = p.chatBuffer[:0]
+
+	p.owner.GetChat().Announce(p.name + " has lost the link.")
+	return true
+}
+
+// Attach gives a link-dead player a new connection.
+func (p *playerEntity) Attach(t Terminal) {
+	p.commandLock.Lock()
+	p.keys = p.keys[:0]
+	p.lineMode = t.GetLineMode()
+	p.commandLock.Unlock()
+
+	p.terminal = t
+	p.output = makeSessionWriter(t)
+	p.linkDead = false
+	p.kicked = false
+	p.textMode = false
+	p.text = nil
+	p.termWidth, p.termHeight = -1, -1
+	p.redraw = true
+	p.idleWarned = false
+	atomic.StoreInt64(&p.lastInput, time.Now().UnixNano())
+
+	p.owner.GetChat().Announce(p.name + " has reconnected.")
+}
+
+// TakeOver moves the player to a new connection, telling the old one why
+// it is being closed.
+func (p *playerEntity) TakeOver(t Terminal) {
+	p.output.Disconnect("\r\nYou have logged in from another connection.\r\n")
+	p.closeOutput()
+	p.Attach(t)
+}
+
+// restorePosition moves a player who has just entered the world to where
+// they were saved, if that is still open ground.
+func restorePosition(p PlayerEntity, x, y int) {
+	theGame.Post(func() {
+		if isOpen(theGame.GetMap(), x, y) {
+			p.SetPosition(x, y)
+		}
+	})
+}
+
+// IsLinkDead reports whether the player is waiting to reconnect.  It
+// may only be used on the game goroutine.
+func (p *playerEntity) IsLinkDead() bool {
+	return p.linkDead
+}
+
+// checkLinkDead removes a link-dead player whose time is up.
+func (p *playerEntity) checkLinkDead() {
+	if !p.removed && time.Since(p.linkDeadSince) > LinkDeadTimeout {
+		p.owner.removeEntity(p)
+	}
+}
+
+// closeOutput stops the player's session writer once it has written
+// what it has.
+func (p *playerEntity) closeOutput() {
+	p.output.Close()
+	log.Printf("%s: %s", p.name, p.output.GetStats())
+	p.output = nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// A testSession is a telnet client logged in over a pipe.  Its session
+// runs the way the connection handlers run it, closing the terminal once
+// runSession returns.
+type testSession struct {
+	client		net.Conn
+	terminal	Terminal
+	done		chan bool
+}
+
+func startTestSession(name string) *testSession {
+	server, client := net.Pipe()
+	go io.Copy(ioutil.Discard, client)
+
+	s := &testSession{client: client,
+		terminal: MakeTerminal(MakeTelnet(server)),
+		done: make(chan bool)}
+
+	go func() {
+		runSession(s.terminal, name, discardLog)
+		s.terminal.Close()
+		close(s.done)
+	}()
+
+	return s
+}
+
+// wait waits for the session to end.
+func (s *testSession) wait(t *testing.T, why string) {
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("session was not ended by %s", why)
+	}
+}
+
+// TestLinkDeadPlayer checks that a player who loses the link keeps their
+// place until they log in again, and that kicking them removes them.
+func TestLinkDeadPlayer(t *testing.T) {
+	restoreDuration(t, &LinkDeadTimeout, time.Minute)
+	g := startTestGame(t)
+
+	first := MakeMemoryTerminal(80, 24)
+	p, resumed := g.JoinPlayer(first, "bob")
+	if p == nil || resumed {
+		t.Fatalf("JoinPlayer = %v, %v; want a new player", p, resumed)
+	}
+
+	g.DisconnectPlayer(p, first)
+	g.Synchronize(func() {
+		if !p.IsLinkDead() || g.FindPlayer("bob") != p {
+			t.Error("player left the world instead of waiting for the link")
+		}
+	})
+
+	second := MakeMemoryTerminal(80, 24)
+	if q, resumed := g.JoinPlayer(second, "bob"); q != p || !resumed {
+		t.Fatalf("JoinPlayer = %v, %v; want the link-dead player back", q, resumed)
+	}
+
+	// The end of the old session must not disturb the new one.
+	g.DisconnectPlayer(p, first)
+	g.Synchronize(func() {
+		if p.IsLinkDead() || p.GetTerminal() != second {
+			t.Error("a stale disconnect detached the player")
+		}
+	})
+
+	g.DisconnectPlayer(p, second)
+	g.Synchronize(func() {
+		p.Kick("")
+		p.Kick("")
+		if g.FindPlayer("bob") != nil || g.GetEntities()[p] {
+			t.Error("kicked link-dead player is still in the world")
+		}
+	})
+}
+
+// TestLinkDeadTimeout lets more link-dead players time out at once than
+// the game can have actions queued.
+func TestLinkDeadTimeout(t *testing.T) {
+	restoreDuration(t, &LinkDeadTimeout, time.Minute)
+	g := startTestGame(t)
+
+	players := make(map[string]PlayerEntity)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("player%d", i)
+		term := MakeMemoryTerminal(80, 24)
+		p, _ := g.JoinPlayer(term, name)
+		g.DisconnectPlayer(p, term)
+		players[name] = p
+	}
+
+	g.Synchronize(func() {
+		LinkDeadTimeout = time.Millisecond
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for left := len(players); left > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d link-dead players never timed out", left)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		g.Synchronize(func() {
+			left = 0
+			for name := range players {
+				if g.FindPlayer(name) != nil {
+					left++
+				}
+			}
+		})
+	}
+}
+
+// TestKick kicks a player and lets their session finish.  Kicked players
+// leave the world at once.
+func TestKick(t *testing.T) {
+	restoreDuration(t, &LinkDeadTimeout, time.Minute)
+	g := startTestGame(t)
+
+	s := startTestSession("erin")
+	defer s.client.Close()
+
+	p := waitForPlayer(t, g, "erin")
+	if p == nil {
+		return
+	}
+
+	g.Synchronize(func() {
+		p.Kick("You have been kicked.")
+	})
+	s.wait(t, "a kick")
+
+	g.Synchronize(func() {
+		if g.FindPlayer("erin") != nil {
+			t.Error("kicked player is still in the world")
+		}
+	})
+}
+
+// TestIdleTimeout leaves a player idle until they are disconnected and
+// lets their session finish.
+func TestIdleTimeout(t *testing.T) {
+	restoreDuration(t, &LinkDeadTimeout, time.Minute)
+	restoreDuration(t, &IdleTimeout, 100 * time.Millisecond)
+	restoreDuration(t, &IdleWarning, 50 * time.Millisecond)
+	g := startTestGame(t)
+
+	s := startTestSession("frank")
+	defer s.client.Close()
+
+	if waitForPlayer(t, g, "frank") == nil {
+		return
+	}
+	s.wait(t, "being idle")
+
+	g.Synchronize(func() {
+		if g.FindPlayer("frank") != nil {
+			t.Error("idle player is still in the world")
+		}
+	})
+}
+
+// TestSecondLogin checks that a second login takes the player over, or
+// is refused, as TakeOverSessions says.
+func TestSecondLogin(t *testing.T) {
+	takeOver := TakeOverSessions
+	t.Cleanup(func() { TakeOverSessions = takeOver })
+	g := startTestGame(t)
+
+	first := MakeMemoryTerminal(80, 24)
+	p, _ := g.JoinPlayer(first, "carol")
+
+	TakeOverSessions = false
+	if q, _ := g.JoinPlayer(MakeMemoryTerminal(80, 24), "carol"); q != nil {
+		t.Error("second login was let in with TakeOverSessions off")
+	}
+
+	TakeOverSessions = true
+	second := MakeMemoryTerminal(80, 24)
+	if q, resumed := g.JoinPlayer(second, "carol"); q != p || !resumed {
+		t.Fatalf("JoinPlayer = %v, %v; want the player taken over", q, resumed)
+	}
+
+	g.Synchronize(func() {
+		if p.GetTerminal() != second {
+			t.Error("player kept the old terminal")
+		}
+	})
+
+	select {
+	case <-first.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("old terminal was never closed")
+	}
+}
+
+// TestTakeOverSession logs in twice over telnet and lets the session
+// that was taken over finish, closing its terminal.
+func TestTakeOverSession(t *testing.T) {
+	takeOver := TakeOverSessions
+	t.Cleanup(func() { TakeOverSessions = takeOver })
+	TakeOverSessions = true
+	g := startTestGame(t)
+
+	first := startTestSession("dave")
+	defer first.client.Close()
+
+	p := waitForPlayer(t, g, "dave")
+	if p == nil {
+		return
+	}
+
+	second := startTestSession("dave")
+	defer second.client.Close()
+	first.wait(t, "a second login")
+
+	g.Synchronize(func() {
+		if g.FindPlayer("dave") != p || p.GetTerminal() != second.terminal || p.IsLinkDead() {
+			t.Error("player did not move to the second session")
+		}
+	})
+
+	second.client.Close()
+	second.wait(t, "closing the connection")
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An sshSession is the SSH counterpart of TelnetData.  It carries a single
+// interactive session over an SSH channel.
+type sshSession struct {
+	conn		*ssh.ServerConn
+	channel		ssh.Channel
+	size		screenSize
+	capsLock	sync.Mutex
+	capabilities	Capabilities
+}
+
+func (s *sshSession) Read(b []byte) (int, error) {
+	return s.channel.Read(b)
+}
+
+func (s *sshSession) Write(b []byte) (int, error) {
+	return s.channel.Write(b)
+}
+
+func (s *sshSession) Close() error {
+	s.channel.Close()
+	return s.conn.Close()
+}
+
+func (s *sshSession) GetScreenSize() (int, int) {
+	return s.size.Get()
+}
+
+func (s *sshSession) GetCapabilities() Capabilities {
+	s.capsLock.Lock()
+	defer s.capsLock.Unlock()
+
+	return s.capabilities
+}
+
+// loadHostKey reads the server's private key from a PEM file, creating a
+// new ed25519 key if the file does not exist yet.
+func loadHostKey(filename string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "mmgorogue host key")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Generated SSH host key %s", filename)
+	return ssh.NewSignerFromKey(key)
+}
+
+// MakeSSHConfig creates a server configuration that checks passwords and
+// public keys against the database.
+func MakeSSHConfig(db Database, hostKeyFile string) (*ssh.ServerConfig, error) {
+	hostKey, err := loadHostKey(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			host := remoteHost(c.RemoteAddr().String())
+			if ok, err := checkPassword(db, host, c.User(), string(password)); err != nil {
+				return nil, err
+			} else if ok {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if db.AuthenticateKey(c.User(), formatPublicKey(key)) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	return config, nil
+}
+
+// formatPublicKey returns a key in authorized_keys form without a
+// comment, which is how keys are stored in the database.
+func formatPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// ParsePublicKey normalizes a line from an authorized_keys file.
+func ParsePublicKey(line string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", err
+	}
+
+	return formatPublicKey(key), nil
+}
+
+// createSSHConnectionHandler creates a goroutine that handles a single
+// SSH connection.  Only the first session channel is used; its shell
+// request starts the game with the name the client authenticated as.
+// Connections the gatekeeper refuses are closed before the handshake.
+func createSSHConnectionHandler(conn net.Conn, config *ssh.ServerConfig) {
+	logPrintf := makeLogPrintf(conn.RemoteAddr().String())
+	host := remoteHost(conn.RemoteAddr().String())
+
+	handlerProc := func() {
+		if err := theGatekeeper.Connect(host); err != nil {
+			logPrintf("Refused: %s", err.Error())
+			conn.Close()
+			return
+		}
+		defer theGatekeeper.Disconnect(host)
+
+		if LoginTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(LoginTimeout))
+		}
+
+		sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			logPrintf("SSH handshake failed: %s", err.Error())
+			conn.Close()
+			return
+		}
+		defer sconn.Close()
+		conn.SetDeadline(time.Time{})
+
+		go ssh.DiscardRequests(reqs)
+
+		done := make(chan bool)
+		defer close(done)
+		go sshKeepAlive(sconn, done)
+
+		for newChannel := range chans {
+			if newChannel.ChannelType() != "session" {
+				newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+				continue
+			}
+
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				logPrintf("%s", err)
+				return
+			}
+
+			session := &sshSession{conn: sconn, channel: channel}
+			session.size.Set(80, 24)
+			if waitForShell(session, requests) {
+				go handleSessionRequests(session, requests)
+
+				// Without a pty the client sends and echoes
+				// whole lines itself.
+				terminal := MakeTerminal(session)
+				if session.GetCapabilities().TerminalType == "" {
+					logPrintf("No terminal requested, using line mode")
+					terminal.SetLineMode(true)
+				}
+				runSession(terminal, sconn.User(), logPrintf)
+				terminal.Close()
+			} else {
+				session.Close()
+			}
+			break
+		}
+
+		logPrintf("Disconnecting\n")
+	}
+
+	go handlerProc()
+}
+
+// sshKeepAlive asks the client for a reply now and then until done is
+// closed, and closes the connection if it does not get one.
+func sshKeepAlive(conn *ssh.ServerConn, done chan bool) {
+	if KeepAliveInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// waitForShell handles requests on a new session until the client asks
+// for a shell, and reports whether it did.
+func waitForShell(s *sshSession, requests <-chan *ssh.Request) bool {
+	for req := range requests {
+		switch req.Type {
+		case "shell":
+			req.Reply(true, nil)
+			return true
+		case "pty-req", "window-change", "env":
+			handleSessionRequest(s, req)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+
+	return false
+}
+
+func handleSessionRequests(s *sshSession, requests <-chan *ssh.Request) {
+	for req := range requests {
+		handleSessionRequest(s, req)
+	}
+}
+
+// handleSessionRequest answers the requests a client may send on a
+// session, keeping track of the terminal size.
+func handleSessionRequest(s *sshSession, req *ssh.Request) {
+	ok := false
+
+	switch req.Type {
+	case "pty-req":
+		// string term, uint32 columns, uint32 rows, ...
+		if term, size, valid := readSSHString(req.Payload); valid && len(size) >= 8 {
+			s.capsLock.Lock()
+			s.capabilities.TerminalType = strings.ToUpper(term)
+			s.capsLock.Unlock()
+
+			s.size.Set(int(binary.BigEndian.Uint32(size)),
+				int(binary.BigEndian.Uint32(size[4:])))
+			ok = true
+		}
+	case "window-change":
+		// uint32 columns, uint32 rows, ...
+		if len(req.Payload) >= 8 {
+			s.size.Set(int(binary.BigEndian.Uint32(req.Payload)),
+				int(binary.BigEndian.Uint32(req.Payload[4:])))
+			ok = true
+		}
+	case "env":
+		// string name, string value
+		if name, rest, valid := readSSHString(req.Payload); valid {
+			if value, _, valid := readSSHString(rest); valid {
+				s.setEnv(name, value)
+			}
+		}
+		ok = true
+	}
+
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
+
+// readSSHString reads a length prefixed string from a request payload.
+func readSSHString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b) - 4) < n {
+		return "", nil, false
+	}
+
+	return string(b[4:4 + n]), b[4 + n:], true
+}
+
+// setEnv notes the environment variables that describe the terminal.
+func (s *sshSession) setEnv(name, value string) {
+	s.capsLock.Lock()
+	defer s.capsLock.Unlock()
+
+	switch name {
+	case "LANG", "LC_ALL", "LC_CTYPE":
+		v := strings.ToUpper(value)
+		if strings.Contains(v, "UTF-8") || strings.Contains(v, "UTF8") {
+			s.capabilities.MTTS |= MttsUTF8
+		}
+	case "COLORTERM":
+		if value == "truecolor" || value == "24bit" {
+			s.capabilities.MTTS |= MttsTrueColor
+		}
+	}
+}
+
+// createSSHListener creates a goroutine that listens for incoming SSH
+// connections.
+func createSSHListener(listener net.Listener, config *ssh.ServerConfig) {
+	listenerProc := func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Print(err)
+				break
+			}
+			log.Printf("SSH connection from: %s\n", conn.RemoteAddr().String())
+
+			createSSHConnectionHandler(conn, config)
+		}
+	}
+
+	go listenerProc()
+}
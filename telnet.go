@@ -1,9 +1,12 @@
 package main
 
 import (
+	"compress/zlib"
+	"fmt"
 	"log"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 )
 
 type TelnetState int
@@ -44,19 +47,21 @@ const (
 	TelnetTerminalType	= 24
 	TelnetTerminalSpeed	= 32
 	TelnetLinemode		= 34
+	TelnetMssp		= 70
+	TelnetMccp2		= 86
+	TelnetGmcp		= 201
 )
 
-const TelnetEsc byte = 0x1b
+// Subnegotiation commands.
+const (
+	TelnetIs byte	= 0
+	TelnetSend	= 1
+)
 
-type Telnet interface {
-	Read(b []byte) (int, error)
-	GoTo(x, y uint16)
-	Put(b ...byte)
-	Write(b []byte)
-	Close() error
-	GetScreenSize() (uint16, uint16)
-	ShowCursor(s bool)
-}
+// The longest subnegotiation kept; anything beyond it is dropped.
+const maxSubnegotiation = 512
+
+const TelnetEsc byte = 0x1b
 
 type TelnetData struct {
 	conn		net.Conn
@@ -64,89 +69,326 @@ type TelnetData struct {
 	subBuffer	[]byte
 	telnetState	TelnetState
 	subCommand	byte
-	negotiations	int
-	width, height	uint16
+	inSub		bool
+	ttypeReplies	int
+	lastTtype	string
+	optionsLock	sync.Mutex
+	options		[256]telnetOption
+	negotiated	bool
+	lineMode	bool
+	writeLock	sync.Mutex
+	compressor	*zlib.Writer
+	wire		*countingWriter
+	rawBytes	int64
+	compressedBytes	int64
+	size		screenSize
+	capsLock	sync.Mutex
+	capabilities	Capabilities
+	changed		chan bool
+	closed		chan bool
+	closeOnce	sync.Once
 }
 
-func MakeTelnet(conn net.Conn) Telnet {
+func MakeTelnet(conn net.Conn) Transport {
 	telnet := &TelnetData{
-		conn,
-		make([]byte, 512),
-		make([]byte, 0, 512),
-		TopLevel,
-		TelnetNop,
-		4,
-		0, 0}
+		conn: conn,
+		buffer: make([]byte, 512),
+		subBuffer: make([]byte, 0, maxSubnegotiation),
+		telnetState: TopLevel,
+		changed: make(chan bool, 1),
+		closed: make(chan bool)}
 	telnet.initialize()
+
+	if KeepAliveInterval > 0 {
+		go telnet.keepAlive(KeepAliveInterval)
+	}
+
 	return telnet
 }
 
+// keepAlive sends a NOP now and then, so that the connection to a client
+// that has gone away fails instead of idling forever.  Clients that have
+// never spoken telnet are spared, since they would show the NOP.
+func (tc *TelnetData) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tc.closed:
+			return
+		case <-ticker.C:
+			tc.optionsLock.Lock()
+			negotiated := tc.negotiated
+			tc.optionsLock.Unlock()
+
+			if !negotiated {
+				continue
+			}
+
+			if _, err := tc.Write([]byte{TelnetIac, TelnetNop}); err != nil {
+				tc.conn.Close()
+				return
+			}
+		}
+	}
+}
+
 func (tc *TelnetData) initialize() {
-	tc.sendCommand(TelnetIac, TelnetWill, TelnetEcho,
-		TelnetIac, TelnetDont, TelnetEcho,
-		TelnetIac, TelnetWill, TelnetSuppressGoAhead,
-		TelnetIac, TelnetDo, TelnetSuppressGoAhead,
-		TelnetIac, TelnetDo, TelnetNaws,
-		TelnetIac, TelnetDo, TelnetTerminalType,
-		TelnetIac, TelnetDo, TelnetTerminalSpeed,
-		TelnetIac, TelnetWont, TelnetLinemode)
+	tc.enableLocal(TelnetEcho)
+	tc.enableLocal(TelnetSuppressGoAhead)
+	tc.enableLocal(TelnetMssp)
+	tc.enableLocal(TelnetMccp2)
+	tc.enableLocal(TelnetGmcp)
+	tc.enableRemote(TelnetSuppressGoAhead)
+	tc.enableRemote(TelnetNaws)
+	tc.enableRemote(TelnetTerminalType)
+	tc.enableRemote(TelnetTerminalSpeed)
+}
+
+// enableLocal asks to perform an option ourselves.
+func (tc *TelnetData) enableLocal(option byte) {
+	tc.sendReply(tc.options[option].us.requestEnable(), TelnetWill, TelnetWont, option)
+}
+
+// disableLocal stops performing an option ourselves.
+func (tc *TelnetData) disableLocal(option byte) {
+	tc.sendReply(tc.options[option].us.requestDisable(), TelnetWill, TelnetWont, option)
+}
+
+// wantLocal tells whether we agree to perform an option.  In line mode
+// the client echoes and edits lines itself.
+func (tc *TelnetData) wantLocal(option byte) bool {
+	if tc.lineMode && (option == TelnetEcho || option == TelnetSuppressGoAhead) {
+		return false
+	}
+
+	return localOptions[option]
+}
+
+// SetLineMode hands echo and line editing over to the client, or takes
+// them back.  Clients that follow the usual convention send whole lines
+// when the server neither echoes nor suppresses go ahead.
+func (tc *TelnetData) SetLineMode(on bool) {
+	tc.optionsLock.Lock()
+	defer tc.optionsLock.Unlock()
+
+	tc.lineMode = on
+	for _, option := range []byte{TelnetEcho, TelnetSuppressGoAhead} {
+		if on {
+			tc.disableLocal(option)
+		} else {
+			tc.enableLocal(option)
+		}
+	}
+}
+
+// enableRemote asks the client to perform an option.
+func (tc *TelnetData) enableRemote(option byte) {
+	tc.sendReply(tc.options[option].him.requestEnable(), TelnetDo, TelnetDont, option)
+}
+
+func (tc *TelnetData) sendReply(reply qReply, enable, disable, option byte) {
+	switch reply {
+	case replyEnable:
+		tc.sendCommand(TelnetIac, enable, option)
+	case replyDisable:
+		tc.sendCommand(TelnetIac, disable, option)
+	}
 }
 
+// handleSubCommand acts on a complete subnegotiation.  Subnegotiations
+// for options the client has not agreed to, and malformed ones, are
+// ignored.
 func (tc *TelnetData) handleSubCommand() {
+	tc.optionsLock.Lock()
+	option := tc.options[tc.subCommand]
+	tc.optionsLock.Unlock()
+
+	if !option.him.Enabled() && !option.us.Enabled() {
+		return
+	}
+
+	data := tc.subBuffer
+
 	switch tc.subCommand {
 	case TelnetNaws:
-		tc.width = uint16(tc.subBuffer[0] << 8 | tc.subBuffer[1])
-		tc.height = uint16(tc.subBuffer[2] << 8 | tc.subBuffer[3])
-		log.Printf("width: %d height: %d", tc.width, tc.height)
-	case TelnetTerminalType:
-		terminalType := string(tc.subBuffer[1:])
-		log.Printf("terminal-type: %s", terminalType)
+		if len(data) != 4 {
+			return
+		}
 
-		if tc.negotiations > 0 && (terminalType != "VT100" && terminalType != "XTERM") {
-			tc.negotiations--
-			tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalType, 1, TelnetIac, TelnetSe)
+		tc.size.Set(int(data[0]) << 8 | int(data[1]),
+			int(data[2]) << 8 | int(data[3]))
+		tc.terminalChanged()
+	case TelnetTerminalType:
+		if len(data) < 1 || data[0] != TelnetIs {
+			return
 		}
+
+		tc.onTerminalType(string(data[1:]))
 	case TelnetTerminalSpeed:
-		log.Printf("terminal-speed: %s", string(tc.subBuffer[1:]))
+		if len(data) < 1 || data[0] != TelnetIs {
+			return
+		}
+
+		log.Printf("terminal-speed: %s", string(data[1:]))
+	case TelnetGmcp:
+		tc.handleGmcp(data)
 	}
 }
 
-func (tc *TelnetData) onWill(command byte) {
-	switch command {
+// The most TTYPE replies asked for.  MTTS clients need three.
+const maxTtypeReplies = 4
+
+// onTerminalType handles a TTYPE reply.  Asking again cycles through the
+// client's names for its terminal: MUD clients following MTTS send their
+// name, then a terminal type, then "MTTS" and a bitfield.  Other clients
+// send a terminal type first and repeat the last one when they run out.
+func (tc *TelnetData) onTerminalType(terminalType string) {
+	log.Printf("terminal-type: %s", terminalType)
+
+	tc.ttypeReplies++
+	repeated := terminalType == tc.lastTtype
+	tc.lastTtype = terminalType
+
+	tc.capsLock.Lock()
+	var mtts int
+	if _, err := fmt.Sscanf(terminalType, "MTTS %d", &mtts); err == nil {
+		tc.capabilities.MTTS = mtts
+		repeated = true
+	} else if tc.ttypeReplies == 1 {
+		tc.capabilities.ClientName = terminalType
+		tc.capabilities.TerminalType = terminalType
+	} else if !repeated {
+		tc.capabilities.TerminalType = terminalType
+	}
+	tc.capsLock.Unlock()
+	tc.terminalChanged()
+
+	if !repeated && tc.ttypeReplies < maxTtypeReplies {
+		tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalType, TelnetSend, TelnetIac, TelnetSe)
+	}
+}
+
+// TerminalChanged returns a channel that receives after the client reports
+// its size or terminal type.
+func (tc *TelnetData) TerminalChanged() <-chan bool {
+	return tc.changed
+}
+
+// terminalChanged wakes up whoever waits on TerminalChanged, unless they
+// have yet to notice an earlier change.
+func (tc *TelnetData) terminalChanged() {
+	select {
+	case tc.changed <- true:
+	default:
+	}
+}
+
+// onRemoteEnabled is called when the client starts performing an option.
+func (tc *TelnetData) onRemoteEnabled(option byte) {
+	switch option {
 	case TelnetTerminalSpeed:
-		tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalSpeed, 1, TelnetIac, TelnetSe)
+		tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalSpeed, TelnetSend, TelnetIac, TelnetSe)
 	case TelnetTerminalType:
-		tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalType, 1, TelnetIac, TelnetSe)
+		tc.sendCommand(TelnetIac, TelnetSb, TelnetTerminalType, TelnetSend, TelnetIac, TelnetSe)
 	}
 }
 
-func (tc *TelnetData) onDo(command byte) {
-	switch command {
-	case TelnetEcho:
-		tc.sendCommand(TelnetIac, TelnetWill, TelnetEcho)
-	case TelnetSuppressGoAhead:
-		tc.sendCommand(TelnetIac, TelnetWill, TelnetSuppressGoAhead)
+func (tc *TelnetData) onWill(option byte) {
+	tc.optionsLock.Lock()
+	tc.negotiated = true
+	reply, enabled := tc.options[option].him.receiveEnable(remoteOptions[option])
+	tc.sendReply(reply, TelnetDo, TelnetDont, option)
+	tc.optionsLock.Unlock()
+
+	if enabled {
+		tc.onRemoteEnabled(option)
+	}
+}
+
+func (tc *TelnetData) onWont(option byte) {
+	tc.optionsLock.Lock()
+	defer tc.optionsLock.Unlock()
+
+	tc.negotiated = true
+
+	reply, _ := tc.options[option].him.receiveDisable()
+	tc.sendReply(reply, TelnetDo, TelnetDont, option)
+}
+
+// onLocalEnabled is called when the client agrees to us performing an
+// option.
+func (tc *TelnetData) onLocalEnabled(option byte) {
+	switch option {
+	case TelnetMssp:
+		tc.sendMssp()
+	case TelnetMccp2:
+		tc.startCompression()
+	case TelnetGmcp:
+		tc.setGmcp(true)
+	}
+}
+
+// onLocalDisabled is called when the client asks us to stop performing
+// an option.
+func (tc *TelnetData) onLocalDisabled(option byte) {
+	switch option {
+	case TelnetMccp2:
+		tc.stopCompression()
+	case TelnetGmcp:
+		tc.setGmcp(false)
+	}
+}
+
+func (tc *TelnetData) onDo(option byte) {
+	tc.optionsLock.Lock()
+	tc.negotiated = true
+	reply, enabled := tc.options[option].us.receiveEnable(tc.wantLocal(option))
+	tc.sendReply(reply, TelnetWill, TelnetWont, option)
+	tc.optionsLock.Unlock()
+
+	if enabled {
+		tc.onLocalEnabled(option)
+	}
+}
+
+func (tc *TelnetData) onDont(option byte) {
+	tc.optionsLock.Lock()
+	tc.negotiated = true
+	reply, disabled := tc.options[option].us.receiveDisable()
+	tc.sendReply(reply, TelnetWill, TelnetWont, option)
+	tc.optionsLock.Unlock()
+
+	if disabled {
+		tc.onLocalDisabled(option)
 	}
 }
 
 func (tc *TelnetData) sendCommand(b ...byte) {
-	tc.conn.Write(b)
+	tc.Write(b)
 }
 
 func (tc *TelnetData) Read(b []byte) (int, error) {
 	writePos := 0
 
 	appendByte := func(cb byte) {
-		if tc.subCommand == TelnetNop {
+		if !tc.inSub {
 			b[writePos] = cb
 			writePos++
-		} else {
+		} else if len(tc.subBuffer) < maxSubnegotiation {
 			tc.subBuffer = append(tc.subBuffer, cb)
 		}
 	}
 
-	for writePos == 0 {
-		n, err := tc.conn.Read(tc.buffer)
+	// Never read more than fits in b, since every byte may be data.
+	buffer := tc.buffer
+	if len(b) < len(buffer) {
+		buffer = buffer[:len(b)]
+	}
+
+	for writePos == 0 && len(b) > 0 {
+		n, err := tc.conn.Read(buffer)
 		if err != nil {
 			return 0, err
 		}
@@ -179,8 +421,10 @@ func (tc *TelnetData) Read(b []byte) (int, error) {
 					tc.telnetState = GotDont
 				case TelnetSe:
 					tc.telnetState = TopLevel
-					tc.handleSubCommand()
-					tc.subCommand = TelnetNop
+					if tc.inSub {
+						tc.handleSubCommand()
+						tc.inSub = false
+					}
 				default:
 					tc.telnetState = TopLevel
 				}
@@ -188,15 +432,18 @@ func (tc *TelnetData) Read(b []byte) (int, error) {
 				tc.onWill(cb)
 				tc.telnetState = TopLevel
 			case GotWont:
+				tc.onWont(cb)
 				tc.telnetState = TopLevel
 			case GotDo:
 				tc.onDo(cb)
 				tc.telnetState = TopLevel
 			case GotDont:
+				tc.onDont(cb)
 				tc.telnetState = TopLevel
 			case GotSb:
 				tc.subCommand = cb
 				tc.subBuffer = tc.subBuffer[:0]
+				tc.inSub = true
 
 				tc.telnetState = TopLevel
 			}
@@ -208,37 +455,61 @@ func (tc *TelnetData) Read(b []byte) (int, error) {
 	return writePos, nil
 }
 
-func (tc *TelnetData) GoTo(x, y uint16) {
-	buffer := make([]byte, 0, 16)
-	buffer = append(buffer, TelnetEsc, '[')
-	buffer = strconv.AppendInt(buffer, int64(y), 10)
-	buffer = append(buffer, ';')
-	buffer = strconv.AppendInt(buffer, int64(x), 10)
-	buffer = append(buffer, 'H')
+// Write sends bytes to the client, compressing them if MCCP2 is on.  It
+// may be called while another goroutine is reading.
+func (tc *TelnetData) Write(b []byte) (int, error) {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
 
-	tc.conn.Write(buffer)
-}
+	if tc.compressor == nil {
+		return tc.conn.Write(b)
+	}
 
-func (tc *TelnetData) Put(b ...byte) {
-	tc.conn.Write(b)
-}
+	n, err := tc.compressor.Write(b)
+	if err == nil {
+		err = tc.compressor.Flush()
+	}
+	tc.rawBytes += int64(n)
 
-func (tc *TelnetData) Write(b []byte) {
-	tc.conn.Write(b)
+	return n, err
 }
 
+// Close closes the connection first, so that a write blocked on a
+// stalled client cannot hold it up.
 func (tc *TelnetData) Close() error {
-	return tc.conn.Close()
+	err := tc.conn.Close()
+	tc.closeOnce.Do(func() { close(tc.closed) })
+
+	tc.writeLock.Lock()
+	compressed := tc.compressor != nil
+	tc.endCompression()
+	tc.writeLock.Unlock()
+
+	if compressed {
+		log.Printf("%s: %s", tc.conn.RemoteAddr().String(), tc.GetCompressionStats())
+	}
+
+	return err
 }
 
-func (tc *TelnetData) GetScreenSize() (uint16, uint16) {
-	return tc.width, tc.height
+// GetScreenSize returns the size reported by the client.  It may be
+// called while another goroutine is reading.
+func (tc *TelnetData) GetScreenSize() (int, int) {
+	return tc.size.Get()
 }
 
-func (tc *TelnetData) ShowCursor(s bool) {
-	if s {
-		tc.sendCommand(TelnetEsc, '[', '?', '2', '5', 'h')
-	} else {
-		tc.sendCommand(TelnetEsc, '[', '?', '2', '5', 'l')
-	}
+func (tc *TelnetData) setGmcp(enabled bool) {
+	tc.capsLock.Lock()
+	defer tc.capsLock.Unlock()
+
+	tc.capabilities.GMCP = enabled
+}
+
+// GetCapabilities returns what the client has told us about its
+// terminal so far.
+func (tc *TelnetData) GetCapabilities() Capabilities {
+	tc.capsLock.Lock()
+	defer tc.capsLock.Unlock()
+
+	return tc.capabilities
 }
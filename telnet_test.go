@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// readTelnet sends input from a client over a pipe and returns the data
+// TelnetData.Read makes of it, reading size bytes at a time.
+func readTelnet(t *testing.T, input []byte, size int) []byte {
+	server, client := net.Pipe()
+
+	// Whatever the server sends back is thrown away.
+	replies := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		close(replies)
+	}()
+
+	tc := MakeTelnet(server).(*TelnetData)
+	go func() {
+		client.Write(input)
+		client.Close()
+	}()
+
+	var data []byte
+	b := make([]byte, size)
+	for {
+		n, err := tc.Read(b)
+		if n > len(b) {
+			t.Fatalf("Read returned %d bytes into a buffer of %d", n, len(b))
+		}
+		data = append(data, b[:n]...)
+
+		if err != nil {
+			break
+		}
+	}
+
+	tc.GetScreenSize()
+	tc.GetCapabilities()
+	tc.Close()
+	<-replies
+
+	return data
+}
+
+// FuzzTelnetRead feeds arbitrary input through the telnet option state
+// machine.  An IAC may only reach the data when the client doubled it.
+// There is no game, so MSSP reports no players.
+func FuzzTelnetRead(f *testing.F) {
+	game := theGame
+	f.Cleanup(func() { theGame = game })
+	theGame = nil
+
+	const iac, se byte = TelnetIac, TelnetSe
+	f.Add([]byte("look\r\n"), uint8(64))
+	f.Add([]byte{iac, iac, 'a', iac, iac, iac}, uint8(1))
+	f.Add([]byte{iac, TelnetWill, TelnetNaws, iac, TelnetSb, TelnetNaws, 0, 80, 0, 24, iac, se, 'x'}, uint8(3))
+	f.Add([]byte{iac, TelnetWill, TelnetTerminalType, iac, TelnetSb, TelnetTerminalType, TelnetIs,
+		'X', 'T', 'E', 'R', 'M', iac, se}, uint8(2))
+	f.Add([]byte{iac, TelnetSb, TelnetNaws, iac, iac, iac, iac}, uint8(8))
+	f.Add([]byte{iac, TelnetDo, TelnetMccp2, iac, TelnetDo, TelnetGmcp, iac, TelnetSb, TelnetGmcp,
+		'C', 'o', 'r', 'e', '.', 'H', 'e', 'l', 'l', 'o', ' ', '{', '}', iac, se}, uint8(5))
+	f.Add([]byte{iac, TelnetDont, TelnetEcho, iac, TelnetWont, TelnetNaws, iac}, uint8(1))
+	f.Add([]byte{iac, TelnetDo, TelnetMssp, 'x'}, uint8(4))
+
+	f.Fuzz(func(t *testing.T, input []byte, size uint8) {
+		data := readTelnet(t, input, 1 + int(size) % 64)
+
+		if got, max := bytes.Count(data, []byte{iac}), bytes.Count(input, []byte{iac, iac}); got > max {
+			t.Errorf("%d IAC bytes in the data from %d escaped ones in %q", got, max, input)
+		}
+	})
+}
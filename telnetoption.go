@@ -0,0 +1,145 @@
+package main
+
+// Option negotiation follows the Q method of RFC 1143, which keeps both
+// ends from looping when they request changes at the same time.  Each
+// option has a state for each side of the connection: whether we perform
+// it (WILL/WONT, answered by DO/DONT) and whether the client does
+// (DO/DONT, answered by WILL/WONT).
+
+type qState int
+
+const (
+	QNo qState = iota
+	QYes
+	QWantNo
+	QWantYes
+)
+
+// What to send the other side after a negotiation step.
+type qReply int
+
+const (
+	replyNone qReply = iota
+	replyEnable
+	replyDisable
+)
+
+// The negotiation state of one side of an option.  opposite is the RFC's
+// queue bit: a request to change back that waits for the answer to the
+// request in flight.
+type qOption struct {
+	state		qState
+	opposite	bool
+}
+
+func (q *qOption) Enabled() bool {
+	return q.state == QYes
+}
+
+// receiveEnable handles the other side asking for, or agreeing to, the
+// option being enabled.  agree tells whether we want it.  It returns
+// what to answer and whether the option has just been enabled.
+func (q *qOption) receiveEnable(agree bool) (qReply, bool) {
+	switch q.state {
+	case QNo:
+		if agree {
+			q.state = QYes
+			return replyEnable, true
+		}
+		return replyDisable, false
+	case QWantNo:
+		// A refusal answered by an agreement is an error; take it as
+		// the other side's answer anyway.
+		if q.opposite {
+			q.state, q.opposite = QYes, false
+			return replyNone, true
+		}
+		q.state = QNo
+	case QWantYes:
+		if q.opposite {
+			q.state, q.opposite = QWantNo, false
+			return replyDisable, false
+		}
+		q.state = QYes
+		return replyNone, true
+	}
+
+	return replyNone, false
+}
+
+// receiveDisable handles the other side refusing, or asking to stop, the
+// option.  It returns what to answer and whether the option has just
+// been disabled.
+func (q *qOption) receiveDisable() (qReply, bool) {
+	switch q.state {
+	case QYes:
+		q.state = QNo
+		return replyDisable, true
+	case QWantNo:
+		if q.opposite {
+			q.state, q.opposite = QWantYes, false
+			return replyEnable, true
+		}
+		q.state = QNo
+		return replyNone, true
+	case QWantYes:
+		q.state, q.opposite = QNo, false
+	}
+
+	return replyNone, false
+}
+
+// requestEnable starts enabling the option, or queues that for when the
+// request in flight has been answered.
+func (q *qOption) requestEnable() qReply {
+	switch q.state {
+	case QNo:
+		q.state = QWantYes
+		return replyEnable
+	case QWantNo:
+		q.opposite = true
+	case QWantYes:
+		q.opposite = false
+	}
+
+	return replyNone
+}
+
+// requestDisable starts disabling the option, or queues that for when
+// the request in flight has been answered.
+func (q *qOption) requestDisable() qReply {
+	switch q.state {
+	case QYes:
+		q.state = QWantNo
+		return replyDisable
+	case QWantNo:
+		q.opposite = false
+	case QWantYes:
+		q.opposite = true
+	}
+
+	return replyNone
+}
+
+// The negotiation state of an option on both sides.
+type telnetOption struct {
+	us	qOption
+	him	qOption
+}
+
+// Options we are willing to perform, and options we want the client to
+// perform.  Anything else is refused.
+var localOptions = map[byte]bool{
+	TelnetEcho:		true,
+	TelnetSuppressGoAhead:	true,
+	TelnetMssp:		true,
+	TelnetMccp2:		true,
+	TelnetGmcp:		true,
+}
+
+var remoteOptions = map[byte]bool{
+	TelnetSuppressGoAhead:	true,
+	TelnetNaws:		true,
+	TelnetTerminalType:	true,
+	TelnetTerminalSpeed:	true,
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Transport carries a terminal session over some wire protocol: telnet,
+// SSH or WebSocket.  It deals only in bytes; all knowledge of escape
+// sequences lives in the Terminal built on top of it.
+type Transport interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	GetScreenSize() (int, int)
+	GetCapabilities() Capabilities
+}
+
+// Transports that can carry out of band packages, such as telnet with
+// GMCP, implement packageSender.
+type packageSender interface {
+	SendPackage(name string, data []byte)
+}
+
+// Transports that can ask the client to edit and echo lines itself, such
+// as telnet, implement lineModeSetter.
+type lineModeSetter interface {
+	SetLineMode(on bool)
+}
+
+// Transports that learn the client's size and terminal type while the
+// session runs, such as telnet, implement terminalWatcher.  The channel
+// receives after the client reports either of them.
+type terminalWatcher interface {
+	TerminalChanged() <-chan bool
+}
+
+// A Terminal is what the game sees of a player's client.  Coordinates are
+// zero based.
+type Terminal interface {
+	// ReadKey blocks until a key is pressed or the session ends.
+	// SetReadTimeout makes it give up after a time without input.
+	ReadKey() (KeyEvent, error)
+	SetReadTimeout(d time.Duration)
+
+	// GoTo, Write and ShowCursor draw directly, outside of frames.
+	GoTo(x, y int)
+	Write(b []byte)
+	ShowCursor(show bool)
+
+	// Draw writes the cells of a frame, first clearing the terminal if
+	// asked to.
+	Draw(frame []ScreenDelta, clear bool)
+
+	// SendPackage sends a GMCP package, if the client takes them.
+	SendPackage(name string, data []byte)
+
+	// In line mode the terminal is treated as a printer: only Write
+	// sends anything, and the client edits and echoes lines itself.
+	SetLineMode(on bool)
+	GetLineMode() bool
+
+	GetSize() (int, int)
+	GetCapabilities() Capabilities
+	GetStats() OutputStats
+	Close() error
+}
+
+// Counters for the output of a session.
+type OutputStats struct {
+	Frames	int64
+	Bytes	int64
+	Writes	int64
+}
+
+func (s OutputStats) String() string {
+	if s.Frames == 0 {
+		return "no frames sent"
+	}
+
+	return fmt.Sprintf("%d frames, %d bytes, %.1f bytes/frame, %.2f writes/frame",
+		s.Frames, s.Bytes, float64(s.Bytes) / float64(s.Frames),
+		float64(s.Writes) / float64(s.Frames))
+}
+
+// The terminal size reported by a client.  Clients report it whenever it
+// changes, over NAWS for telnet or with a message for other frontends,
+// while the game reads it from another goroutine.
+type screenSize struct {
+	lock		sync.Mutex
+	width, height	int
+}
+
+func (s *screenSize) Set(width, height int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.width, s.height = width, height
+}
+
+func (s *screenSize) Get() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.width, s.height
+}
+
+// An ansiTerminal drives an ANSI/VT100 terminal over a transport.
+type ansiTerminal struct {
+	stats		OutputStats
+	transport	Transport
+	keys		*KeyReader
+	encoder		*FrameEncoder
+	writeLock	sync.Mutex
+	lineMode	bool
+	closeOnce	sync.Once
+	closeErr	error
+}
+
+// MakeTerminal creates a terminal that talks ANSI over a transport.  The
+// terminal takes over reading from the transport.
+func MakeTerminal(t Transport) Terminal {
+	return &ansiTerminal{transport: t,
+		keys: MakeKeyReader(t),
+		encoder: MakeFrameEncoder(80)}
+}
+
+func (t *ansiTerminal) ReadKey() (KeyEvent, error) {
+	return t.keys.ReadKey()
+}
+
+func (t *ansiTerminal) SetReadTimeout(d time.Duration) {
+	t.keys.SetTimeout(d)
+}
+
+// write sends bytes to the transport.  The caller must hold writeLock.
+func (t *ansiTerminal) write(b []byte) {
+	t.transport.Write(b)
+
+	atomic.AddInt64(&t.stats.Bytes, int64(len(b)))
+	atomic.AddInt64(&t.stats.Writes, 1)
+}
+
+func (t *ansiTerminal) GoTo(x, y int) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.lineMode {
+		return
+	}
+
+	t.write(appendCursorPosition(nil, x, y))
+	t.encoder.Invalidate()
+}
+
+func (t *ansiTerminal) Write(b []byte) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.write(b)
+	t.encoder.Invalidate()
+}
+
+func (t *ansiTerminal) ShowCursor(show bool) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.lineMode {
+		return
+	}
+
+	if show {
+		t.write([]byte{TelnetEsc, '[', '?', '2', '5', 'h'})
+	} else {
+		t.write([]byte{TelnetEsc, '[', '?', '2', '5', 'l'})
+	}
+}
+
+// Draw encodes a frame and sends it with a single write.
+func (t *ansiTerminal) Draw(frame []ScreenDelta, clear bool) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.lineMode {
+		return
+	}
+
+	if clear {
+		t.encoder.Reset()
+	}
+
+	if w, _ := t.transport.GetScreenSize(); w > 0 {
+		t.encoder.SetWidth(w)
+	}
+	caps := t.transport.GetCapabilities()
+	t.encoder.SetColorDepth(caps.ColorDepth())
+	t.encoder.SetCharset(caps.Charset())
+
+	t.write(t.encoder.Encode(frame))
+	atomic.AddInt64(&t.stats.Frames, 1)
+}
+
+func (t *ansiTerminal) SendPackage(name string, data []byte) {
+	sender, ok := t.transport.(packageSender)
+	if !ok {
+		return
+	}
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	sender.SendPackage(name, data)
+}
+
+func (t *ansiTerminal) SetLineMode(on bool) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.lineMode = on
+	if setter, ok := t.transport.(lineModeSetter); ok {
+		setter.SetLineMode(on)
+	}
+}
+
+func (t *ansiTerminal) GetLineMode() bool {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	return t.lineMode
+}
+
+// TerminalChanged returns the transport's channel for changes to the
+// size and terminal type, or nil if they never change.
+func (t *ansiTerminal) TerminalChanged() <-chan bool {
+	if watcher, ok := t.transport.(terminalWatcher); ok {
+		return watcher.TerminalChanged()
+	}
+
+	return nil
+}
+
+func (t *ansiTerminal) GetSize() (int, int) {
+	return t.transport.GetScreenSize()
+}
+
+func (t *ansiTerminal) GetCapabilities() Capabilities {
+	return t.transport.GetCapabilities()
+}
+
+// GetStats returns the output counters so far.  It may be called from
+// any goroutine.
+func (t *ansiTerminal) GetStats() OutputStats {
+	return OutputStats{atomic.LoadInt64(&t.stats.Frames),
+		atomic.LoadInt64(&t.stats.Bytes),
+		atomic.LoadInt64(&t.stats.Writes)}
+}
+
+// Close ends the session.  Both the session writer and the connection
+// handler close the terminal, so only the first close does anything.
+func (t *ansiTerminal) Close() error {
+	t.closeOnce.Do(func() {
+		t.keys.Close()
+		t.closeErr = t.transport.Close()
+	})
+
+	return t.closeErr
+}
+
+var errTerminalClosed = errors.New("terminal closed")
+
+// A MemoryTerminal keeps its cells in memory and takes its keys from
+// SendKeys.  It stands in for a real client when testing.
+type MemoryTerminal struct {
+	lock		sync.Mutex
+	width, height	int
+	cells		[][]rune
+	cx, cy		int
+	keys		chan KeyEvent
+	closed		chan bool
+	closeOnce	sync.Once
+	stats		OutputStats
+	packages	map[string]string
+	lineMode	bool
+	timeout		time.Duration
+}
+
+func MakeMemoryTerminal(width, height int) *MemoryTerminal {
+	t := &MemoryTerminal{width: width,
+		height: height,
+		cells: make([][]rune, height),
+		keys: make(chan KeyEvent, 64),
+		closed: make(chan bool),
+		packages: make(map[string]string)}
+
+	for i := range t.cells {
+		t.cells[i] = []rune(strings.Repeat(" ", width))
+	}
+
+	return t
+}
+
+// SendKeys queues keys as if they had been typed.
+func (t *MemoryTerminal) SendKeys(keys ...KeyEvent) {
+	for _, k := range keys {
+		select {
+		case t.keys <- k:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *MemoryTerminal) ReadKey() (KeyEvent, error) {
+	var idle <-chan time.Time
+	if t.timeout > 0 {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	select {
+	case k := <-t.keys:
+		return k, nil
+	case <-t.closed:
+		return KeyEvent{}, errTerminalClosed
+	case <-idle:
+		return KeyEvent{}, errReadTimeout
+	}
+}
+
+func (t *MemoryTerminal) SetReadTimeout(d time.Duration) {
+	t.timeout = d
+}
+
+func (t *MemoryTerminal) GoTo(x, y int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.lineMode {
+		t.cx, t.cy = x, y
+	}
+}
+
+func (t *MemoryTerminal) Write(b []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.write([]rune(string(b)))
+	t.stats.Bytes += int64(len(b))
+	t.stats.Writes++
+}
+
+// write puts characters at the cursor, moving it for carriage returns,
+// line feeds and backspaces as a terminal would.  The caller must hold
+// lock.
+func (t *MemoryTerminal) write(r []rune) {
+	for _, c := range r {
+		switch c {
+		case '\r':
+			t.cx = 0
+		case '\n':
+			t.lineFeed()
+		case '\b':
+			t.cx = Maxi(0, t.cx - 1)
+		default:
+			if t.cy >= 0 && t.cy < t.height && t.cx >= 0 && t.cx < t.width {
+				t.cells[t.cy][t.cx] = c
+			}
+			t.cx++
+		}
+	}
+}
+
+// lineFeed moves the cursor down a line, scrolling at the bottom.
+func (t *MemoryTerminal) lineFeed() {
+	if t.cy < t.height - 1 {
+		t.cy++
+		return
+	}
+
+	last := t.cells[0]
+	copy(t.cells, t.cells[1:])
+	for i := range last {
+		last[i] = ' '
+	}
+	t.cells[t.height - 1] = last
+}
+
+func (*MemoryTerminal) ShowCursor(show bool) {
+}
+
+func (t *MemoryTerminal) Draw(frame []ScreenDelta, clear bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.lineMode {
+		return
+	}
+
+	if clear {
+		for _, row := range t.cells {
+			for i := range row {
+				row[i] = ' '
+			}
+		}
+	}
+
+	for _, d := range frame {
+		t.cx, t.cy = d.x, d.y
+		t.write(d.data)
+		t.stats.Bytes += int64(len(string(d.data)))
+	}
+	t.stats.Frames++
+	t.stats.Writes++
+}
+
+// SendPackage keeps the latest data of each package for GetPackage.
+func (t *MemoryTerminal) SendPackage(name string, data []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.packages[name] = string(data)
+}
+
+// GetPackage returns the latest data sent for a package.
+func (t *MemoryTerminal) GetPackage(name string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.packages[name]
+}
+
+// GetLine returns a row of the terminal as text.
+func (t *MemoryTerminal) GetLine(y int) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return string(t.cells[y])
+}
+
+func (t *MemoryTerminal) SetLineMode(on bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lineMode = on
+}
+
+func (t *MemoryTerminal) GetLineMode() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.lineMode
+}
+
+func (t *MemoryTerminal) GetSize() (int, int) {
+	return t.width, t.height
+}
+
+func (*MemoryTerminal) GetCapabilities() Capabilities {
+	return Capabilities{TerminalType: "MEMORY", GMCP: true}
+}
+
+func (t *MemoryTerminal) GetStats() OutputStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.stats
+}
+
+func (t *MemoryTerminal) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestTerminalCloseTwice closes a terminal the way sessions do: once from
+// the session writer and once more from the connection handler.
+func TestTerminalCloseTwice(t *testing.T) {
+	term := MakeTerminal(&countingTransport{})
+	if err := term.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Close(); err != nil {
+		t.Errorf("second close: %s", err)
+	}
+
+	if _, err := term.ReadKey(); err == nil {
+		t.Error("read a key from a closed terminal")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// In text mode a player gets lines of text instead of a drawn screen:
+// chat as it arrives, descriptions of what is around them on request and
+// notes when they bump into things or enter a new area.  It is meant for
+// players with screen readers, for whom the map is only noise.
+
+// The farthest away /look reports other entities.
+const lookRadius = 10
+
+// The most text kept for a client that has fallen behind.
+const maxPendingText = 16384
+
+// SetTextMode switches the player between text and the drawn screen.  It
+// may be called from any goroutine.
+func (p *playerEntity) SetTextMode(on bool) {
+	p.owner.Post(func() {
+		p.setTextMode(on)
+	})
+}
+
+func (p *playerEntity) setTextMode(on bool) {
+	if on == p.textMode {
+		return
+	}
+
+	p.textMode = on
+	p.redraw = true
+
+	if on && p.lineMode {
+		p.printLine("Type a command and press Enter.  Type help for a list of commands.")
+	} else if on {
+		p.printLine("Screen reader mode is on.  Press Enter to chat, and type /look to hear your surroundings or /where for your position.")
+	}
+
+	if on {
+		for _, line := range p.describeSurroundings() {
+			p.printLine(line)
+		}
+	}
+}
+
+// echo queues text to show in text mode, such as the keys typed in the
+// chat line.
+func (p *playerEntity) echo(s string) {
+	if !p.textMode || len(p.text) > maxPendingText {
+		return
+	}
+
+	charset := p.terminal.GetCapabilities().Charset()
+	for _, r := range s {
+		switch r {
+		case '\r', '\n', '\b':
+			p.text = append(p.text, byte(r))
+		default:
+			p.text = appendRune(p.text, r, charset)
+		}
+	}
+}
+
+// printLine queues a line of text in text mode.  A chat line being typed
+// is moved below it.
+func (p *playerEntity) printLine(s string) {
+	if !p.chatting {
+		p.echo(s + "\r\n")
+		return
+	}
+
+	p.echo("\r\n" + s + "\r\n> " + string(p.chatBuffer))
+}
+
+// postText hands queued text to the session writer.
+func (p *playerEntity) postText() {
+	if p.redraw {
+		p.output.Redraw()
+		p.redraw = false
+	}
+
+	var packages []gmcpPackage
+	if p.terminal.GetCapabilities().GMCP {
+		packages = p.gmcpPackages()
+	}
+
+	p.output.SendText(p.text, packages)
+	p.text = nil
+}
+
+// directionName returns the compass direction of an offset, ignoring how
+// far it is.
+func directionName(dx, dy int) string {
+	d := [2]int{0, 0}
+	if dx != 0 {
+		d[0] = dx / Absi(dx)
+	}
+	if dy != 0 {
+		d[1] = dy / Absi(dy)
+	}
+
+	for a, offset := range actionDirections {
+		if offset == d {
+			return a.String()
+		}
+	}
+
+	return "here"
+}
+
+// describeOffset says where something is relative to the player, e.g.
+// "3 east, 1 north".
+func describeOffset(dx, dy int) string {
+	parts := make([]string, 0, 2)
+	if dx != 0 {
+		parts = append(parts, fmt.Sprintf("%d %s", Absi(dx), directionName(dx, 0)))
+	}
+	if dy != 0 {
+		parts = append(parts, fmt.Sprintf("%d %s", Absi(dy), directionName(0, dy)))
+	}
+
+	if len(parts) == 0 {
+		return "right here"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// tileName returns what a tile that blocks movement is, or an empty
+// string for tiles that can be walked on.
+func tileName(tile byte) string {
+	switch tile {
+	case '#':
+		return "wall"
+	case '~':
+		return "water"
+	}
+
+	return ""
+}
+
+// The order surroundings are described in.
+var compass = []Action{ActionNorth, ActionEast, ActionSouth, ActionWest,
+	ActionNorthEast, ActionSouthEast, ActionSouthWest, ActionNorthWest}
+
+// describeBlocked says in which directions the player cannot move, e.g.
+// "Wall to the north and west; water to the south."
+func (p *playerEntity) describeBlocked() string {
+	m := p.owner.GetMap()
+	mw, mh := m.GetSize()
+
+	names := make([]string, 0, 2)
+	directions := make(map[string][]string)
+	for _, a := range compass {
+		d := actionDirections[a]
+		x, y := p.x + d[0], p.y + d[1]
+
+		name := "water"
+		if x >= 0 && x < mw && y >= 0 && y < mh {
+			name = tileName(m.GetTile(x, y))
+		}
+		if name == "" {
+			continue
+		}
+
+		if directions[name] == nil {
+			names = append(names, name)
+		}
+		directions[name] = append(directions[name], a.String())
+	}
+
+	if len(names) == 0 {
+		return "The way is open in every direction."
+	}
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + " to the " + joinWords(directions[name])
+	}
+
+	return capitalize(strings.Join(parts, "; ")) + "."
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// joinWords joins words into a list such as "north, east and west".
+func joinWords(words []string) string {
+	if len(words) == 1 {
+		return words[0]
+	}
+
+	return strings.Join(words[:len(words) - 1], ", ") + " and " + words[len(words) - 1]
+}
+
+// entityName returns how an entity is referred to in descriptions.
+func entityName(e Entity) string {
+	switch e := e.(type) {
+	case PlayerEntity:
+		return e.GetName()
+	case *dog:
+		return "A dog"
+	}
+
+	return "Something"
+}
+
+// A nearby entity and how far away it is.
+type sighting struct {
+	name		string
+	dx, dy		int
+}
+
+type sightingsByDistance []sighting
+
+func (s sightingsByDistance) Len() int		{ return len(s) }
+func (s sightingsByDistance) Swap(i, j int)	{ s[i], s[j] = s[j], s[i] }
+func (s sightingsByDistance) Less(i, j int) bool {
+	di, dj := Maxi(Absi(s[i].dx), Absi(s[i].dy)), Maxi(Absi(s[j].dx), Absi(s[j].dy))
+	return di < dj || di == dj && s[i].name < s[j].name
+}
+
+// describeSurroundings returns what /look reports: where the player is,
+// what blocks their way and who is nearby, nearest first.
+func (p *playerEntity) describeSurroundings() []string {
+	lines := []string{"You are in " + zoneAt(p.x, p.y) + ".", p.describeBlocked()}
+
+	sightings := make([]sighting, 0, 8)
+	for e := range p.owner.GetEntities() {
+		x, y := e.GetPosition()
+		dx, dy := x - p.x, y - p.y
+		if e == Entity(p) || Maxi(Absi(dx), Absi(dy)) > lookRadius {
+			continue
+		}
+
+		sightings = append(sightings, sighting{entityName(e), dx, dy})
+	}
+	sort.Sort(sightingsByDistance(sightings))
+
+	if len(sightings) == 0 {
+		return append(lines, "Nobody else is nearby.")
+	}
+
+	for _, s := range sightings {
+		lines = append(lines, fmt.Sprintf("%s is %s.", s.name, describeOffset(s.dx, s.dy)))
+	}
+
+	return lines
+}
+
+// moved tells a player in text mode about the area they walked into.
+func (p *playerEntity) moved(fromX, fromY int) {
+	if zone := zoneAt(p.x, p.y); zone != zoneAt(fromX, fromY) {
+		p.printLine("You enter " + zone + ".")
+	}
+}
+
+// blocked tells a player in text mode why they could not move.
+func (p *playerEntity) blocked(tile byte, dx, dy int) {
+	p.printLine(capitalize(tileName(tile)) + " to the " + directionName(dx, dy) + ".")
+}
+
+func doLook(p *playerEntity, args string) {
+	for _, line := range p.describeSurroundings() {
+		p.notify(line)
+	}
+}
+
+func doWhere(p *playerEntity, args string) {
+	p.notify(fmt.Sprintf("You are in %s, at %d, %d.", zoneAt(p.x, p.y), p.x, p.y))
+}
+
+// doScreenReader switches screen reader mode on or off and saves the
+// choice to the player's account.
+func doScreenReader(p *playerEntity, args string) {
+	args = strings.ToLower(args)
+	on := !p.textMode
+	switch args {
+	case "":
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		p.notify("Usage: /screenreader [on|off]")
+		return
+	}
+
+	if on == p.textMode {
+		p.notify("Screen reader mode is already " + args + ".")
+		return
+	} else if p.lineMode {
+		p.notify("This terminal can only show text.")
+		return
+	}
+
+	p.setTextMode(on)
+	if !on {
+		p.notify("Screen reader mode is off.")
+	}
+
+	name := p.GetName()
+	theDatabaseWriter.Save(func() error {
+		return theDatabase.SetScreenReader(name, on)
+	}, func(err error) {
+		p.owner.Post(func() {
+			p.notify("Your screen reader setting could not be saved.")
+		})
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTLSHandshakeTimeout connects over TLS and never starts the
+// handshake.  The server must give up on it and hang up.
+func TestTLSHandshakeTimeout(t *testing.T) {
+	restore := saveLimits()
+	t.Cleanup(restore)
+	theGatekeeper = MakeGatekeeper("")
+	restoreDuration(t, &TLSHandshakeTimeout, 50 * time.Millisecond)
+
+	dir := t.TempDir()
+	config, err := MakeTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	createConnectionHandler(tls.Server(pipeConn{server, "10.0.0.1:4000"}, config))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Errorf("connection was not closed: %s", err)
+	}
+}
@@ -16,4 +16,13 @@ func Mini(a, b int) int {
 	}
 
 	return b
-}
\ No newline at end of file
+}
+
+// Absi returns the absolute value of an integer.
+func Absi(a int) int {
+	if a < 0 {
+		return -a
+	}
+
+	return a
+}
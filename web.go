@@ -0,0 +1,171 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// The page served to browsers.  It runs xterm.js and bridges it to the
+// WebSocket endpoint.
+const webClientPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mmgorogue</title>
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.css">
+<script src="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.js"></script>
+<script src="https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0/lib/addon-fit.js"></script>
+<style>
+html, body { margin: 0; height: 100%; background: #000; }
+#terminal { height: 100%; }
+</style>
+</head>
+<body>
+<div id="terminal"></div>
+<script>
+var term = new Terminal({cols: 80, rows: 24});
+var fit = new FitAddon.FitAddon();
+term.loadAddon(fit);
+term.open(document.getElementById("terminal"));
+fit.fit();
+
+var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+var ws = new WebSocket(scheme + location.host + "/ws");
+ws.binaryType = "arraybuffer";
+
+function send(message) {
+	if (ws.readyState === WebSocket.OPEN) {
+		ws.send(JSON.stringify(message));
+	}
+}
+
+function sendSize() {
+	send({type: "resize", cols: term.cols, rows: term.rows});
+}
+
+ws.onopen = sendSize;
+ws.onmessage = function(e) { term.write(new Uint8Array(e.data)); };
+ws.onclose = function() { term.write("\r\n[Disconnected]\r\n"); };
+term.onData(function(data) { send({type: "input", data: data}); });
+term.onResize(sendSize);
+window.addEventListener("resize", function() { fit.fit(); });
+term.focus();
+</script>
+</body>
+</html>
+`
+
+// A message from the browser: either typed input or a new terminal size.
+type webMessage struct {
+	Type	string	`json:"type"`
+	Data	string	`json:"data"`
+	Cols	int	`json:"cols"`
+	Rows	int	`json:"rows"`
+}
+
+// A webSession carries a session over a WebSocket connection.  Output is
+// sent as binary messages; input and resizes arrive as JSON messages.
+type webSession struct {
+	ws	*websocket.Conn
+	pending	[]byte
+	size	screenSize
+}
+
+func (s *webSession) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		var msg webMessage
+		if err := websocket.JSON.Receive(s.ws, &msg); err != nil {
+			return 0, err
+		}
+
+		switch msg.Type {
+		case "input":
+			s.pending = append(s.pending, msg.Data...)
+		case "resize":
+			if msg.Cols > 0 && msg.Rows > 0 {
+				s.size.Set(msg.Cols, msg.Rows)
+			}
+		}
+	}
+
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *webSession) Write(b []byte) (int, error) {
+	if err := websocket.Message.Send(s.ws, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *webSession) Close() error {
+	return s.ws.Close()
+}
+
+func (s *webSession) GetScreenSize() (int, int) {
+	return s.size.Get()
+}
+
+// GetCapabilities describes xterm.js, which is what the served page runs.
+func (*webSession) GetCapabilities() Capabilities {
+	return Capabilities{ClientName: "xterm.js",
+		TerminalType: "XTERM-256COLOR",
+		MTTS: MttsAnsi | MttsVT100 | MttsUTF8 | Mtts256Colors | MttsTrueColor}
+}
+
+// handleWebSocket runs a session for a browser, just like a telnet
+// connection.
+func handleWebSocket(ws *websocket.Conn) {
+	logPrintf := makeLogPrintf(ws.Request().RemoteAddr)
+	logPrintf("WebSocket connection\n")
+
+	host := remoteHost(ws.Request().RemoteAddr)
+	if err := theGatekeeper.Connect(host); err != nil {
+		logPrintf("Refused: %s", err.Error())
+		websocket.Message.Send(ws, []byte(capitalize(err.Error()) + ".\r\n"))
+		ws.Close()
+		return
+	}
+	defer theGatekeeper.Disconnect(host)
+
+	session := &webSession{ws: ws}
+	session.size.Set(80, 24)
+
+	terminal := MakeTerminal(session)
+	defer terminal.Close()
+
+	if authenticated, name := doAuthentication(terminal, host); authenticated {
+		runSession(terminal, name, logPrintf)
+	}
+
+	logPrintf("Disconnecting\n")
+}
+
+func serveWebClient(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webClientPage)
+}
+
+// createWebListener creates a goroutine that serves the browser client
+// and its WebSocket endpoint.
+func createWebListener(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveWebClient)
+	mux.Handle("/ws", websocket.Handler(handleWebSocket))
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Print(err)
+		}
+	}()
+}
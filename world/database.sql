@@ -32,3 +32,38 @@ CREATE TABLE IF NOT EXISTS inventory (
        FOREIGN KEY (item_id) REFERENCES items(id)
        	       ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS keybindings (
+       user_id INT NOT NULL,
+       key_name CHAR(32) NOT NULL,
+       action CHAR(32) NOT NULL,
+       PRIMARY KEY (user_id, key_name),
+       FOREIGN KEY (user_id) REFERENCES users(id)
+       	       ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_keys (
+       user_id INT NOT NULL,
+       public_key VARCHAR(1024) NOT NULL,
+       key_hash CHAR(64) NOT NULL,
+       PRIMARY KEY (user_id, key_hash),
+       FOREIGN KEY (user_id) REFERENCES users(id)
+       	       ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_settings (
+       user_id INT NOT NULL,
+       screen_reader BOOLEAN NOT NULL DEFAULT FALSE,
+       PRIMARY KEY (user_id),
+       FOREIGN KEY (user_id) REFERENCES users(id)
+       	       ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_positions (
+       user_id INT NOT NULL,
+       x INT NOT NULL,
+       y INT NOT NULL,
+       PRIMARY KEY (user_id),
+       FOREIGN KEY (user_id) REFERENCES users(id)
+       	       ON DELETE CASCADE
+);
@@ -64,4 +64,86 @@ BEGIN
        LIMIT 1;
 END//
 
+DROP PROCEDURE IF EXISTS user_keybindings;
+CREATE PROCEDURE user_keybindings(user_name CHAR(16))
+BEGIN
+	SELECT key_name, action
+	FROM keybindings
+	INNER JOIN users ON keybindings.user_id = users.id
+	WHERE users.user_name = user_name;
+END//
+
+DROP PROCEDURE IF EXISTS set_user_keybinding;
+CREATE PROCEDURE set_user_keybinding(user_name CHAR(16), key_name CHAR(32), action CHAR(32))
+BEGIN
+	REPLACE INTO keybindings VALUES(
+		(SELECT id FROM users WHERE users.user_name = user_name),
+		key_name,
+		action
+	);
+END//
+
+DROP PROCEDURE IF EXISTS authenticate_key;
+CREATE PROCEDURE authenticate_key(user_name CHAR(16), public_key VARCHAR(1024))
+BEGIN
+	IF EXISTS(SELECT * FROM user_keys
+		INNER JOIN users ON user_keys.user_id = users.id
+		WHERE users.user_name = user_name
+		AND user_keys.public_key = public_key)
+	THEN
+		UPDATE users SET last_login = NOW() WHERE users.user_name = user_name;
+		SELECT 1 AS 'success';
+	ELSE SELECT 0 AS 'success';
+	END IF;
+END//
+
+DROP PROCEDURE IF EXISTS add_user_key;
+CREATE PROCEDURE add_user_key(user_name CHAR(16), public_key VARCHAR(1024))
+BEGIN
+	INSERT IGNORE INTO user_keys VALUES(
+		(SELECT id FROM users WHERE users.user_name = user_name),
+		public_key,
+		SHA2(public_key, 256)
+	);
+	SELECT ROW_COUNT() > 0 AS 'added';
+END//
+
+DROP PROCEDURE IF EXISTS user_screen_reader;
+CREATE PROCEDURE user_screen_reader(user_name CHAR(16))
+BEGIN
+	IF EXISTS(SELECT * FROM user_settings
+		INNER JOIN users ON user_settings.user_id = users.id
+		WHERE users.user_name = user_name
+		AND user_settings.screen_reader)
+	THEN SELECT 1 AS 'screen_reader';
+	ELSE SELECT 0 AS 'screen_reader';
+	END IF;
+END//
+
+DROP PROCEDURE IF EXISTS set_user_screen_reader;
+CREATE PROCEDURE set_user_screen_reader(user_name CHAR(16), screen_reader BOOLEAN)
+BEGIN
+	INSERT INTO user_settings VALUES(
+		(SELECT id FROM users WHERE users.user_name = user_name),
+		screen_reader
+	) ON DUPLICATE KEY UPDATE user_settings.screen_reader = screen_reader;
+END//
+
+DROP PROCEDURE IF EXISTS user_position;
+CREATE PROCEDURE user_position(user_name CHAR(16))
+BEGIN
+	SELECT user_positions.x, user_positions.y FROM user_positions
+		INNER JOIN users ON user_positions.user_id = users.id
+		WHERE users.user_name = user_name;
+END//
+
+DROP PROCEDURE IF EXISTS set_user_position;
+CREATE PROCEDURE set_user_position(user_name CHAR(16), x INT, y INT)
+BEGIN
+	INSERT INTO user_positions VALUES(
+		(SELECT id FROM users WHERE users.user_name = user_name),
+		x, y
+	) ON DUPLICATE KEY UPDATE user_positions.x = x, user_positions.y = y;
+END//
+
 DELIMITER ;